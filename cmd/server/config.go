@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	ListenAddr     string `env:"LISTEN_ADDR" envDefault:":7000"`
+	ProwlarrURL    string `env:"PROWLARR_URL"`
+	ProwlarrAPIKey string `env:"PROWLARR_API_KEY"`
+	Production     bool   `env:"PRODUCTION"`
+
+	LogFormat string `env:"LOG_FORMAT" envDefault:"json"`
+	LogLevel  string `env:"LOG_LEVEL" envDefault:"info"`
+
+	UserDataSecret     string `env:"USER_DATA_SECRET"`
+	AllowPlainUserData bool   `env:"ALLOW_PLAIN_USER_DATA"`
+
+	OutboundAllowedCIDRs   []string `env:"OUTBOUND_ALLOWED_CIDRS"`
+	OutboundDeniedCIDRs    []string `env:"OUTBOUND_DENIED_CIDRS"`
+	OutboundAllowedSchemes []string `env:"OUTBOUND_ALLOWED_SCHEMES" envDefault:"http,https"`
+
+	// TrustedProxies are the IPs or CIDRs whose ProxyHeader is used as the client IP, e.g. Cloudflare's.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+	ProxyHeader    string   `env:"PROXY_HEADER" envDefault:"X-Forwarded-For"`
+
+	ProfileDBPath string `env:"PROFILE_DB_PATH"`
+	// ProfileTTL is how long unused profiles are kept, zero keeps them forever.
+	ProfileTTL time.Duration `env:"PROFILE_TTL" envDefault:"4320h"`
+
+	StreamRatePerMinute    int `env:"STREAM_RATE_PER_MINUTE" envDefault:"30"`
+	StreamRateBurst        int `env:"STREAM_RATE_BURST" envDefault:"10"`
+	DownloadRatePerMinute  int `env:"DOWNLOAD_RATE_PER_MINUTE" envDefault:"60"`
+	DownloadRateBurst      int `env:"DOWNLOAD_RATE_BURST" envDefault:"20"`
+	MaxConcurrentPipelines int `env:"MAX_CONCURRENT_PIPELINES" envDefault:"50"`
+
+	IndexerFailureThreshold int           `env:"INDEXER_FAILURE_THRESHOLD" envDefault:"3"`
+	IndexerCoolDown         time.Duration `env:"INDEXER_COOL_DOWN" envDefault:"5m"`
+
+	IndexersCacheTTL time.Duration `env:"PROWLARR_INDEXERS_CACHE_TTL" envDefault:"1m"`
+	SearchCacheTTL   time.Duration `env:"PROWLARR_SEARCH_CACHE_TTL" envDefault:"5m"`
+	// ProwlarrCacheMaxEntries caps the number of Prowlarr responses kept.
+	ProwlarrCacheMaxEntries int `env:"PROWLARR_CACHE_MAX_ENTRIES" envDefault:"10000"`
+	// CacheSizeMB is the size of the cache of info hashes and download links.
+	CacheSizeMB int `env:"CACHE_SIZE_MB" envDefault:"50"`
+
+	// AdminToken protects the admin endpoints, which are disabled without it.
+	AdminToken string `env:"ADMIN_TOKEN"`
+
+	SearchConcurrency    int           `env:"PIPELINE_SEARCH_CONCURRENCY" envDefault:"10"`
+	InfoHashConcurrency  int           `env:"PIPELINE_INFOHASH_CONCURRENCY" envDefault:"10"`
+	DebridWorkers        int           `env:"PIPELINE_DEBRID_WORKERS" envDefault:"2"`
+	MediaFileConcurrency int           `env:"PIPELINE_MEDIA_FILE_CONCURRENCY" envDefault:"5"`
+	StreamsTimeout       time.Duration `env:"PIPELINE_TIMEOUT" envDefault:"20s"`
+	MaxStreams           int           `env:"MAX_STREAMS" envDefault:"5"`
+
+	RealDebridURL string `env:"REALDEBRID_URL" envDefault:"https://api.real-debrid.com/rest/1.0"`
+	CinemetaURL   string `env:"CINEMETA_URL" envDefault:"https://v3-cinemeta.strem.io"`
+
+	// TMDBAPIKey makes TMDB the source of metadata instead of Cinemeta.
+	TMDBAPIKey string `env:"TMDB_API_KEY"`
+	// TMDBLanguage localizes titles, e.g. "fr-FR", its region also picks the alternative titles searched.
+	TMDBLanguage string `env:"TMDB_LANGUAGE"`
+	TMDBURL      string `env:"TMDB_URL" envDefault:"https://api.themoviedb.org/3"`
+
+	ProxyStreams           bool `env:"PROXY_STREAMS"`
+	ProxyMaxStreamsPerUser int  `env:"PROXY_MAX_STREAMS_PER_USER" envDefault:"2"`
+}
+
+// loadConfig reads the config from the YAML file at path, if any, and environ, which takes precedence.
+// The keys of the file are the names of the env variables, in any case, e.g. prowlarr_url.
+func loadConfig(path string, environ map[string]string) (config, error) {
+	cfg := config{}
+	values := map[string]string{}
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		values = fileValues
+	}
+
+	for key, value := range environ {
+		values[key] = value
+	}
+
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: values}); err != nil {
+		return cfg, fmt.Errorf("invalid config: %w", namedParseErrors(err))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// namedParseErrors names the env variables of invalid values instead of the fields of config.
+func namedParseErrors(err error) error {
+	aggErr, ok := err.(env.AggregateError)
+	if !ok {
+		return err
+	}
+
+	errs := make([]error, 0, len(aggErr.Errors))
+	for _, err := range aggErr.Errors {
+		if parseErr, ok := err.(env.ParseError); ok {
+			if field, found := reflect.TypeOf(config{}).FieldByName(parseErr.Name); found {
+				err = fmt.Errorf("%s: invalid %s: %w", field.Tag.Get("env"), parseErr.Type, parseErr.Err)
+			}
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// readConfigFile returns the values of the config file by env variable.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the config file: %w", err)
+	}
+
+	raw := map[string]any{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("couldn't parse the config file %s: %w", path, err)
+	}
+
+	params, err := env.GetFieldParams(&config{})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(params))
+	for _, param := range params {
+		known[param.Key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	errs := []error{}
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%s: unknown option", key))
+			continue
+		}
+
+		str, err := formatConfigValue(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		values[name] = str
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// formatConfigValue formats a value of the config file as an env variable, lists are comma-separated.
+func formatConfigValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			str, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, str)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("nested options aren't supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// validate reports every invalid option at once, by env variable.
+func (cfg config) validate() error {
+	errs := []error{}
+	check := func(ok bool, name, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{name}, args...)...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(cfg.ListenAddr)
+	check(err == nil, "LISTEN_ADDR", "must be host:port, got %q", cfg.ListenAddr)
+
+	if cfg.ProwlarrURL != "" {
+		check(isHTTPURL(cfg.ProwlarrURL), "PROWLARR_URL", "must be an http(s) URL, got %q", cfg.ProwlarrURL)
+	}
+	check((cfg.ProwlarrURL == "") == (cfg.ProwlarrAPIKey == ""), "PROWLARR_API_KEY", "must be set together with PROWLARR_URL")
+	check(isHTTPURL(cfg.RealDebridURL), "REALDEBRID_URL", "must be an http(s) URL, got %q", cfg.RealDebridURL)
+	check(isHTTPURL(cfg.CinemetaURL), "CINEMETA_URL", "must be an http(s) URL, got %q", cfg.CinemetaURL)
+	check(isHTTPURL(cfg.TMDBURL), "TMDB_URL", "must be an http(s) URL, got %q", cfg.TMDBURL)
+
+	for _, proxy := range cfg.TrustedProxies {
+		check(isIPOrCIDR(proxy), "TRUSTED_PROXIES", "must be IPs or CIDRs, got %q", proxy)
+	}
+
+	// zero disables these limits
+	for name, value := range map[string]int{
+		"STREAM_RATE_PER_MINUTE":   cfg.StreamRatePerMinute,
+		"STREAM_RATE_BURST":        cfg.StreamRateBurst,
+		"DOWNLOAD_RATE_PER_MINUTE": cfg.DownloadRatePerMinute,
+		"DOWNLOAD_RATE_BURST":      cfg.DownloadRateBurst,
+		"MAX_CONCURRENT_PIPELINES": cfg.MaxConcurrentPipelines,
+	} {
+		check(value >= 0, name, "mustn't be negative, got %d", value)
+	}
+	check(cfg.ProfileTTL >= 0, "PROFILE_TTL", "mustn't be negative, got %s", cfg.ProfileTTL)
+
+	for name, value := range map[string]int{
+		"INDEXER_FAILURE_THRESHOLD":       cfg.IndexerFailureThreshold,
+		"CACHE_SIZE_MB":                   cfg.CacheSizeMB,
+		"PROWLARR_CACHE_MAX_ENTRIES":      cfg.ProwlarrCacheMaxEntries,
+		"PIPELINE_SEARCH_CONCURRENCY":     cfg.SearchConcurrency,
+		"PIPELINE_INFOHASH_CONCURRENCY":   cfg.InfoHashConcurrency,
+		"PIPELINE_DEBRID_WORKERS":         cfg.DebridWorkers,
+		"PIPELINE_MEDIA_FILE_CONCURRENCY": cfg.MediaFileConcurrency,
+		"MAX_STREAMS":                     cfg.MaxStreams,
+		"PROXY_MAX_STREAMS_PER_USER":      cfg.ProxyMaxStreamsPerUser,
+	} {
+		check(value > 0, name, "must be positive, got %d", value)
+	}
+
+	for name, value := range map[string]time.Duration{
+		"INDEXER_COOL_DOWN":           cfg.IndexerCoolDown,
+		"PROWLARR_INDEXERS_CACHE_TTL": cfg.IndexersCacheTTL,
+		"PROWLARR_SEARCH_CACHE_TTL":   cfg.SearchCacheTTL,
+		"PIPELINE_TIMEOUT":            cfg.StreamsTimeout,
+	} {
+		check(value > 0, name, "must be positive, got %s", value)
+	}
+
+	// sorted as maps are iterated in random order
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func isIPOrCIDR(value string) bool {
+	if _, err := netip.ParseAddr(value); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(value)
+	return err == nil
+}
+
+// upstreamHosts are the host:port pairs of the services the server is configured to talk to.
+func (cfg config) upstreamHosts() []string {
+	hosts := []string{}
+	for _, rawURL := range []string{cfg.ProwlarrURL, cfg.RealDebridURL, cfg.CinemetaURL, cfg.TMDBURL} {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		hosts = append(hosts, net.JoinHostPort(u.Hostname(), port))
+	}
+	return hosts
+}
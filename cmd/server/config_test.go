@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("should use the defaults", func(t *testing.T) {
+		cfg, err := loadConfig("", map[string]string{})
+		require.NoError(t, err)
+		require.Equal(t, ":7000", cfg.ListenAddr)
+		require.Equal(t, 20*time.Second, cfg.StreamsTimeout)
+		require.Equal(t, "https://api.real-debrid.com/rest/1.0", cfg.RealDebridURL)
+	})
+
+	t.Run("should read the file and let env variables take precedence", func(t *testing.T) {
+		path := writeConfigFile(t, `
+listen_addr: "127.0.0.1:8000"
+PROWLARR_URL: http://prowlarr:9696
+prowlarr_api_key: file-key
+max_streams: 3
+pipeline_timeout: 15s
+outbound_denied_cidrs:
+  - 10.0.0.0/8
+  - 192.168.0.0/16
+`)
+
+		cfg, err := loadConfig(path, map[string]string{"PROWLARR_API_KEY": "env-key"})
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1:8000", cfg.ListenAddr)
+		require.Equal(t, "http://prowlarr:9696", cfg.ProwlarrURL)
+		require.Equal(t, "env-key", cfg.ProwlarrAPIKey)
+		require.Equal(t, 3, cfg.MaxStreams)
+		require.Equal(t, 15*time.Second, cfg.StreamsTimeout)
+		require.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, cfg.OutboundDeniedCIDRs)
+		require.Equal(t, 5*time.Minute, cfg.SearchCacheTTL)
+		require.Equal(t, 10000, cfg.ProwlarrCacheMaxEntries)
+	})
+
+	t.Run("should reject unknown options", func(t *testing.T) {
+		path := writeConfigFile(t, "prowlar_url: http://prowlarr:9696\n")
+		_, err := loadConfig(path, map[string]string{})
+		require.ErrorContains(t, err, "prowlar_url: unknown option")
+	})
+
+	t.Run("should report every invalid option", func(t *testing.T) {
+		_, err := loadConfig("", map[string]string{
+			"LISTEN_ADDR":      "7000",
+			"PROWLARR_URL":     "prowlarr:9696",
+			"MAX_STREAMS":      "0",
+			"PIPELINE_TIMEOUT": "-1s",
+			"TRUSTED_PROXIES":  "10.0.0.0/8,proxy",
+		})
+		require.ErrorContains(t, err, "LISTEN_ADDR: must be host:port")
+		require.ErrorContains(t, err, "PROWLARR_URL: must be an http(s) URL")
+		require.ErrorContains(t, err, "PROWLARR_API_KEY: must be set together with PROWLARR_URL")
+		require.ErrorContains(t, err, "MAX_STREAMS: must be positive")
+		require.ErrorContains(t, err, "PIPELINE_TIMEOUT: must be positive")
+		require.ErrorContains(t, err, `TRUSTED_PROXIES: must be IPs or CIDRs, got "proxy"`)
+		require.NotContains(t, err.Error(), "10.0.0.0/8")
+	})
+
+	t.Run("should report values which can't be parsed", func(t *testing.T) {
+		_, err := loadConfig("", map[string]string{"MAX_STREAMS": "five"})
+		require.ErrorContains(t, err, "MAX_STREAMS")
+	})
+}
@@ -1,78 +1,251 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"log/slog"
 	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/log"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/keyauth"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
 
 	"github.com/bongnv/prowlarr-stremio/internal/addon"
-	"github.com/bongnv/prowlarr-stremio/internal/static"
+	"github.com/bongnv/prowlarr-stremio/internal/cinemeta"
+	"github.com/bongnv/prowlarr-stremio/internal/health"
+	"github.com/bongnv/prowlarr-stremio/internal/logging"
+	"github.com/bongnv/prowlarr-stremio/internal/netguard"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipeotel"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipeprom"
+	"github.com/bongnv/prowlarr-stremio/internal/profile"
+	"github.com/bongnv/prowlarr-stremio/internal/prom"
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/proxy"
+	"github.com/bongnv/prowlarr-stremio/internal/ratelimit"
+	"github.com/bongnv/prowlarr-stremio/internal/tmdb"
 )
 
-type config struct {
-	ProwlarrURL    string `env:"PROWLARR_URL"`
-	ProwlarrAPIKey string `env:"PROWLARR_API_KEY"`
-	Production     bool   `env:"PRODUCTION"`
-}
+const (
+	profilePruneInterval = time.Hour
+	shutdownTimeout      = 30 * time.Second
+)
 
 var (
-	maskedPathPattern = regexp.MustCompile(`^/([\w%]+)/(?:configure|stream|download|manifest)`)
+	maskedPathPattern = regexp.MustCompile(`^/([\w%-]+)/(?:configure|stream|explain|download|manifest|profile)`)
 	version           = "0.1.0-dev"
 )
 
 func main() {
-	cfg := config{}
-	_ = env.Parse(&cfg)
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file, env variables take precedence")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, env.ToMap(os.Environ()))
+	if err != nil {
+		fatal("Failed to load the config", err)
+	}
+
+	logger, err := logging.New(os.Stdout, logging.Config{Format: cfg.LogFormat, Level: cfg.LogLevel})
+	if err != nil {
+		fatal("Invalid logging config", err)
+	}
+	slog.SetDefault(logger)
 
-	app := fiber.New()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metrics := prom.New(prometheus.DefaultRegisterer)
+
+	app := fiber.New(fiber.Config{
+		// forwarding headers can be spoofed by clients which don't go through the trusted proxies
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          cfg.TrustedProxies,
+		ProxyHeader:             cfg.ProxyHeader,
+	})
+	app.Use(logging.Middleware(logger, maskPath))
 	app.Use(cors.New())
+	// outside of recover to observe panics as errors
+	app.Use(metrics.Middleware())
 	app.Use(recover.New(recover.Config{
 		EnableStackTrace: true,
 	}))
 
-	app.Use(logger.New(logger.Config{
-		CustomTags: map[string]logger.LogFunc{
-			"maskedPath": func(output logger.Buffer, c *fiber.Ctx, data *logger.Data, extraParam string) (int, error) {
-				urlPath := c.Path()
-				loc := maskedPathPattern.FindStringSubmatchIndex(urlPath)
-				if len(loc) > 3 {
-					return output.WriteString(urlPath[:loc[2]] + "***" + urlPath[loc[3]:])
-				} else {
-					return output.WriteString(urlPath)
-				}
-			},
-		},
-		Format:        "${time} | ${status} | ${latency} | ${ip} | ${method} | ${maskedPath} | ${error}\n",
-		TimeFormat:    "15:04:05",
-		TimeZone:      "Local",
-		TimeInterval:  500 * time.Millisecond,
-		Output:        os.Stdout,
-		DisableColors: false,
-	}))
+	guard, err := netguard.New(netguard.Config{
+		AllowedCIDRs:   cfg.OutboundAllowedCIDRs,
+		DeniedCIDRs:    cfg.OutboundDeniedCIDRs,
+		AllowedSchemes: cfg.OutboundAllowedSchemes,
+		TrustedHosts:   cfg.upstreamHosts(),
+	})
+	if err != nil {
+		fatal("Invalid outbound policy", err)
+	}
+	transport := guard.Transport()
+
+	pipeMetrics := pipeprom.New(prometheus.DefaultRegisterer)
+	tracer := otel.Tracer("github.com/bongnv/prowlarr-stremio")
 
-	add := addon.New(
+	addonOpts := []addon.Option{
 		addon.WithID("stremio.addon.prowlarr"),
 		addon.WithName("Prowlarr"),
 		addon.WithProwlarr(cfg.ProwlarrURL, cfg.ProwlarrAPIKey),
 		addon.WithDevelopment(!cfg.Production),
 		addon.WithVersion(version),
-	)
+		addon.WithUserDataSecret(cfg.UserDataSecret, cfg.AllowPlainUserData),
+		addon.WithTransport(transport),
+		addon.WithMaxConcurrentPipelines(cfg.MaxConcurrentPipelines),
+		addon.WithCacheSize(cfg.CacheSizeMB * 1024 * 1024),
+		addon.WithRealDebridURL(cfg.RealDebridURL),
+		addon.WithMetaProvider(cinemeta.New(
+			cinemeta.WithBaseURL(cfg.CinemetaURL),
+			cinemeta.WithTransport(transport),
+		)),
+		addon.WithMetrics(metrics),
+		addon.WithIndexerHealth(health.New(health.Config{
+			FailureThreshold: cfg.IndexerFailureThreshold,
+			CoolDown:         cfg.IndexerCoolDown,
+		})),
+		addon.WithProwlarrCache(prowlarr.NewCache(prowlarr.CacheConfig{
+			IndexersTTL: cfg.IndexersCacheTTL,
+			SearchTTL:   cfg.SearchCacheTTL,
+			MaxEntries:  cfg.ProwlarrCacheMaxEntries,
+		})),
+		addon.WithPipelineConfig(addon.PipelineConfig{
+			SearchConcurrency:    cfg.SearchConcurrency,
+			InfoHashConcurrency:  cfg.InfoHashConcurrency,
+			DebridWorkers:        cfg.DebridWorkers,
+			MediaFileConcurrency: cfg.MediaFileConcurrency,
+			Timeout:              cfg.StreamsTimeout,
+			MaxStreams:           cfg.MaxStreams,
+		}),
+		addon.WithPipeObserver(func(ctx context.Context) pipe.Observer {
+			return pipe.MultiObserver(pipeMetrics, pipeotel.New(ctx, tracer))
+		}),
+	}
+
+	if cfg.UserDataSecret == "" {
+		slog.Warn("USER_DATA_SECRET is not set, userData will be stored in plain text in addon URLs")
+	}
+
+	if cfg.ProxyStreams {
+		addonOpts = append(addonOpts, addon.WithStreamProxy(proxy.New(
+			proxy.WithMaxStreamsPerUser(cfg.ProxyMaxStreamsPerUser),
+			proxy.WithTransport(transport),
+		)))
+	}
+
+	if cfg.TMDBAPIKey != "" {
+		addonOpts = append(addonOpts, addon.WithMetaProvider(tmdb.New(
+			cfg.TMDBAPIKey,
+			tmdb.WithLanguage(cfg.TMDBLanguage),
+			tmdb.WithBaseURL(cfg.TMDBURL),
+			tmdb.WithTransport(transport),
+		)))
+	}
+
+	var store *profile.Store
+	if cfg.ProfileDBPath != "" {
+		store, err = profile.Open(cfg.ProfileDBPath)
+		if err != nil {
+			fatal("Failed to open the profile store", err)
+		}
+		if cfg.ProfileTTL > 0 {
+			go store.ExpireUnused(ctx, cfg.ProfileTTL, profilePruneInterval)
+		}
+
+		addonOpts = append(addonOpts, addon.WithProfileStore(store))
+	}
 
+	add := addon.New(addonOpts...)
+
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
 	app.Get("/manifest.json", add.HandleGetManifest)
 	app.Get("/:userData/manifest.json", add.HandleGetManifest)
-	app.Get("/:userData/stream/:type/:id.json", add.HandleGetStreams)
-	app.Get("/:userData/download/:infoHash/:fileID", add.HandleDownload)
-	app.Head("/:userData/download/:infoHash/:fileID", add.HandleDownload)
-	app.Get("/configure", static.HandleConfigure)
-	app.Get("/:userData/configure", static.HandleConfigure)
+	streamLimit := ratelimit.Middleware(
+		ratelimit.New(ratelimit.Config{PerMinute: cfg.StreamRatePerMinute, Burst: cfg.StreamRateBurst}),
+		add.RateLimitKey,
+		ratelimit.ByIP(),
+	)
+	downloadLimit := ratelimit.Middleware(
+		ratelimit.New(ratelimit.Config{PerMinute: cfg.DownloadRatePerMinute, Burst: cfg.DownloadRateBurst}),
+		add.RateLimitKey,
+		ratelimit.ByIP(),
+	)
+
+	ipLimit := ratelimit.Middleware(
+		ratelimit.New(ratelimit.Config{PerMinute: cfg.StreamRatePerMinute, Burst: cfg.StreamRateBurst}),
+		ratelimit.ByIP(),
+	)
+
+	app.Get("/:userData/stream/:type/:id.json", streamLimit, add.HandleGetStreams)
+	app.Get("/:userData/explain/:type/:id.json", streamLimit, add.HandleExplain)
+	app.Get("/:userData/download/:infoHash/:fileID", downloadLimit, add.HandleDownload)
+	app.Post("/encrypt", ipLimit, add.HandleEncrypt)
+	app.Post("/profile", ipLimit, add.HandleSaveProfile)
+	app.Post("/validate", ipLimit, add.HandleValidate)
+	app.Get("/configure", add.HandleConfigure)
+	app.Get("/:userData/configure", add.HandleConfigure)
+
+	if cfg.AdminToken != "" {
+		admin := app.Group("/admin", keyauth.New(keyauth.Config{
+			Validator: func(_ *fiber.Ctx, key string) (bool, error) {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminToken)) != 1 {
+					return false, keyauth.ErrMissingOrMalformedAPIKey
+				}
+				return true, nil
+			},
+		}))
+		admin.Get("/indexers", add.HandleIndexerHealth)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		slog.Info("Shutting down")
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			slog.Error("Failed to shut down gracefully", "error", err)
+		}
+	}()
+
+	listenErr := app.Listen(cfg.ListenAddr)
+	if listenErr == nil {
+		// Listen returns as soon as the listener is closed, requests may still be in flight
+		<-shutdownDone
+	}
+
+	if store != nil {
+		if err := store.Close(); err != nil {
+			slog.Error("Failed to close the profile store", "error", err)
+		}
+	}
+
+	if listenErr != nil {
+		fatal("Failed to start the server", listenErr)
+	}
+}
+
+// maskPath hides the user data of paths as it holds API keys.
+func maskPath(urlPath string) string {
+	loc := maskedPathPattern.FindStringSubmatchIndex(urlPath)
+	if len(loc) > 3 {
+		return urlPath[:loc[2]] + "***" + urlPath[loc[3]:]
+	}
+	return urlPath
+}
 
-	log.Fatal(app.Listen(":7000"))
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
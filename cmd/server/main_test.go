@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskPath(t *testing.T) {
+	testCases := map[string]string{
+		"/manifest.json":                        "/manifest.json",
+		"/token/manifest.json":                  "/***/manifest.json",
+		"/token/stream/movie/tt1.json":          "/***/stream/movie/tt1.json",
+		"/token/download/hash/1":                "/***/download/hash/1",
+		"/%7B%22rd%22%3A%22key%22%7D/configure": "/***/configure",
+		"/token/profile":                        "/***/profile",
+		"/profile":                              "/profile",
+	}
+
+	for path, expected := range testCases {
+		require.Equal(t, expected, maskPath(path), path)
+	}
+}
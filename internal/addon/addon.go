@@ -1,36 +1,54 @@
 package addon
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"net/url"
+	"log/slog"
+	"net/http"
 	"path"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/adrg/strutil/metrics"
 	"github.com/bongnv/prowlarr-stremio/internal/cinemeta"
 	"github.com/bongnv/prowlarr-stremio/internal/debrid/realdebrid"
+	"github.com/bongnv/prowlarr-stremio/internal/health"
 	"github.com/bongnv/prowlarr-stremio/internal/model"
 	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/profile"
+	"github.com/bongnv/prowlarr-stremio/internal/prom"
 	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/proxy"
+	"github.com/bongnv/prowlarr-stremio/internal/ratelimit"
 	"github.com/bongnv/prowlarr-stremio/internal/titleparser"
 	"github.com/coocood/freecache"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/log"
 )
 
 const (
-	cacheSize           = 50 * 1024 * 1024 // 50MB
-	downloadURLExpiry   = 5 * 60
-	maxTitleDistance    = 5
-	maxStreamsResult    = 5
-	infoHashCacheExpiry = 24 * 60 * 60 // 1 day
-	maxSizeInBytes      = 30 * 1 << 30 // 30GB
+	defaultCacheSize     = 50 * 1024 * 1024 // 50MB
+	downloadURLExpiry    = 5 * 60
+	maxTitleDistance     = 5
+	infoHashCacheExpiry  = 24 * 60 * 60 // 1 day
+	maxSizeInBytes       = 30 * 1 << 30 // 30GB
+	pipelineRetryAfter   = 5 * time.Second
+	minGoodResolution    = 1080
+	streamsSoftDeadline  = 10 * time.Second
+	infoHashRetryBackoff = 500 * time.Millisecond
+	debridRetryBackoff   = 200 * time.Millisecond
+	debridBatchMinSize   = 5
+	debridBatchMaxWait   = 300 * time.Millisecond
+	dedupeWindow         = 500 * time.Millisecond
+	indexerSearchTimeout = 10 * time.Second
+	maxSearchAliases     = 2
+	maxProfileSize       = 16 * 1024
+	userDataLocal        = "userData"
 )
 
 var (
@@ -74,17 +92,57 @@ type Addon struct {
 	description string
 	development bool
 
-	cinemetaClient *cinemeta.CineMeta
+	metaProvider   MetaProvider
 	prowlarrClient *prowlarr.Prowlarr
+	prowlarrURL    string
+	prowlarrAPIKey string
+	prowlarrCache  *prowlarr.Cache
+	transport      http.RoundTripper
 	cache          *freecache.Cache
+	cacheSize      int
+	realDebridURL  string
+	streamProxy    *proxy.Proxy
+
+	userDataSecret     string
+	allowPlainUserData bool
+	userDataCodec      *userDataCodec
+	profileStore       *profile.Store
+
+	// pipelineSlots caps the number of stream pipelines running at the same time.
+	pipelineSlots  chan struct{}
+	newObserver    func(ctx context.Context) pipe.Observer
+	pipelineConfig PipelineConfig
+	indexerHealth  *health.Tracker
+	metrics        *prom.Metrics
 }
 
 type Option func(*Addon)
 
+// MetaProvider fetches the metadata of the titles to search for by IMDb ID.
+type MetaProvider interface {
+	GetMovieById(ctx context.Context, id string) (*model.MetaInfo, error)
+	// GetSeriesById returns the meta of a series, with the air date of the episode if the provider knows it.
+	GetSeriesById(ctx context.Context, id string, season, episode int) (*model.MetaInfo, error)
+}
+
 type GetStreamsResponse struct {
 	Streams []StreamItem `json:"streams"`
 }
 
+type EncryptResponse struct {
+	Token string `json:"token"`
+}
+
+// SaveProfileRequest is a configuration to store, with the ID of the profile to update if there's one.
+type SaveProfileRequest struct {
+	UserData
+	ProfileID string `json:"profileId,omitempty"`
+}
+
+type ProfileResponse struct {
+	ID string `json:"id"`
+}
+
 type streamRecord struct {
 	ContentType    ContentType
 	ID             string
@@ -95,34 +153,71 @@ type streamRecord struct {
 	MetaInfo       *model.MetaInfo
 	TitleInfo      *titleparser.MetaInfo
 	Indexer        *prowlarr.Indexer
+	Indexers       []*prowlarr.Indexer
 	Torrent        *prowlarr.Torrent
 	Files          []*realdebrid.File
 	MediaFile      *realdebrid.File
 	SearchBySeason bool
 	RDClient       *realdebrid.RealDebrid
 	Prowlarr       *prowlarr.Prowlarr
+
+	// IndexerPriorities are the indexers chosen by the user, nil if all indexers are used.
+	IndexerPriorities map[int]IndexerPriority
+	// Tier limits the search to the indexers of a priority, 0 searches all of them.
+	Tier IndexerPriority
+	// Priority is the best priority of the indexers which found the torrent.
+	Priority IndexerPriority
+	// Explainer records the decisions made on the torrent, nil unless the request is explained.
+	Explainer *explainer
 }
 
 func New(opts ...Option) *Addon {
 	addon := &Addon{
-		description:    "A Stremio addon",
-		cinemetaClient: cinemeta.New(),
-		cache:          freecache.NewCache(cacheSize),
+		description: "A Stremio addon",
+		cacheSize:   defaultCacheSize,
+		transport:   http.DefaultTransport,
 	}
 
 	for _, opt := range opts {
 		opt(addon)
 	}
 
-	if addon.prowlarrClient == nil {
-		panic("prowlarr client must be provided")
+	addon.cache = freecache.NewCache(addon.cacheSize)
+	addon.pipelineConfig = addon.pipelineConfig.withDefaults()
+	if addon.indexerHealth == nil {
+		addon.indexerHealth = health.New(health.Config{})
+	}
+	if addon.prowlarrCache == nil {
+		addon.prowlarrCache = prowlarr.NewCache(prowlarr.CacheConfig{})
+	}
+	if addon.metaProvider == nil {
+		addon.metaProvider = cinemeta.New(cinemeta.WithTransport(addon.transport))
+	}
+	addon.prowlarrClient = prowlarr.New(addon.prowlarrURL, addon.prowlarrAPIKey, prowlarr.WithTransport(addon.transport), prowlarr.WithCache(addon.prowlarrCache))
+
+	codec, err := newUserDataCodec(addon.userDataSecret, addon.allowPlainUserData)
+	if err != nil {
+		panic(fmt.Sprintf("invalid userData secret: %v", err))
 	}
+	addon.userDataCodec = codec
 
 	return addon
 }
 
+// newRealDebrid creates a client of the RD account of apiKey, which reports its requests to the metrics.
+func (add *Addon) newRealDebrid(apiKey, ipAddress string) *realdebrid.RealDebrid {
+	opts := []realdebrid.Option{
+		realdebrid.WithTransport(add.transport),
+		realdebrid.WithRequestObserver(add.metrics.DebridRequest),
+	}
+	if add.realDebridURL != "" {
+		opts = append(opts, realdebrid.WithBaseURL(add.realDebridURL))
+	}
+	return realdebrid.New(apiKey, ipAddress, opts...)
+}
+
 func (add *Addon) HandleGetManifest(c *fiber.Ctx) error {
-	_, err := parseUserData(c)
+	_, err := add.parseUserData(c)
 
 	manifest := &Manifest{
 		ID:          add.id,
@@ -148,34 +243,122 @@ func (add *Addon) HandleGetManifest(c *fiber.Ctx) error {
 	return c.JSON(manifest)
 }
 
+// HandleEncrypt turns the configuration posted by the configure page into an opaque userData token.
+func (add *Addon) HandleEncrypt(c *fiber.Ctx) error {
+	userData := &UserData{}
+	if err := c.BodyParser(userData); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid configuration")
+	}
+
+	if userData.RDAPIKey == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "RD API token is required")
+	}
+
+	token, err := add.userDataCodec.encode(userData)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(EncryptResponse{
+		Token: token,
+	})
+}
+
+// HandleSaveProfile stores the posted configuration server-side.
+// The profile whose ID is posted is updated in place if it exists, otherwise a new profile is created.
+// The ID is posted in the body rather than the path as it's a credential, which mustn't be logged.
+func (add *Addon) HandleSaveProfile(c *fiber.Ctx) error {
+	if add.profileStore == nil {
+		return fiber.ErrNotFound
+	}
+
+	if len(c.Body()) > maxProfileSize {
+		return fiber.ErrRequestEntityTooLarge
+	}
+
+	req := &SaveProfileRequest{}
+	if err := c.BodyParser(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid configuration")
+	}
+
+	if req.RDAPIKey == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "RD API token is required")
+	}
+
+	data, err := add.userDataCodec.encode(&req.UserData)
+	if err != nil {
+		return err
+	}
+
+	id := req.ProfileID
+	if profile.IsID(id) {
+		err = add.profileStore.Update(c.UserContext(), id, data)
+		if err == nil {
+			return c.JSON(ProfileResponse{
+				ID: id,
+			})
+		}
+
+		if !errors.Is(err, profile.ErrNotFound) {
+			return err
+		}
+	}
+
+	id, err = add.profileStore.Create(c.UserContext(), data)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(ProfileResponse{
+		ID: id,
+	})
+}
+
 func (add *Addon) HandleDownload(c *fiber.Ctx) error {
 	infoHash := strings.ToLower(c.Params("infoHash"))
 	fileID := strings.ToLower(c.Params("fileID"))
-	ipAddress := getIPAddress(c)
-	userData, err := parseUserData(c)
+	userData, err := add.parseUserData(c)
 	if err != nil {
 		return errors.New("invalid user data")
 	}
 
-	realDebrid := realdebrid.New(userData.RDAPIKey, ipAddress)
+	// When streams are proxied, RD only sees the server so the client IP mustn't be forwarded.
+	ipAddress := ""
+	if add.streamProxy == nil {
+		ipAddress = getIPAddress(c)
+	}
+
+	realDebrid := add.newRealDebrid(userData.RDAPIKey, ipAddress)
 
 	var downloadURL string
-	rawDownloadURL, err := add.cache.Get([]byte(userData.RDAPIKey + infoHash + fileID))
+	cacheKey := []byte(userData.RDAPIKey + infoHash + fileID)
+	rawDownloadURL, err := add.cache.Get(cacheKey)
+	add.metrics.CacheLookup(prom.CacheDownloadURL, err == nil)
 	if err != nil {
-		downloadURL, err = realDebrid.GetDownloadByInfoHash(infoHash, fileID)
+		downloadURL, err = realDebrid.GetDownloadByInfoHash(c.UserContext(), infoHash, fileID)
 		if err != nil {
-			log.WithContext(c.Context()).Errorf("Couldn't generate the download link for %s, %s: %v", infoHash, fileID, err)
+			slog.ErrorContext(c.UserContext(), "Couldn't generate the download link", "info_hash", infoHash, "file_id", fileID, "error", err)
 			return err
 		}
 
-		err = add.cache.Set([]byte(userData.RDAPIKey+infoHash+fileID), []byte(downloadURL), downloadURLExpiry)
+		err = add.cache.Set(cacheKey, []byte(downloadURL), downloadURLExpiry)
 		if err != nil {
-			log.WithContext(c.Context()).Warnf("Failed to cache downloadURL: %v", err)
+			slog.WarnContext(c.UserContext(), "Failed to cache the download link", "error", err)
 		}
 	} else {
 		downloadURL = string(rawDownloadURL)
 	}
 
+	if add.streamProxy != nil {
+		err = add.streamProxy.Serve(c, userData.RDAPIKey, downloadURL)
+		if errors.Is(err, proxy.ErrBadUpstream) {
+			// the link may have expired, so the next attempt generates a new one
+			slog.WarnContext(c.UserContext(), "Real-Debrid rejected the download link", "info_hash", infoHash, "file_id", fileID)
+			add.cache.Del(cacheKey)
+		}
+		return err
+	}
+
 	if !add.development {
 		c.Response().Header.Add("Cache-control", "max-age=86400, public")
 	}
@@ -183,26 +366,18 @@ func (add *Addon) HandleDownload(c *fiber.Ctx) error {
 }
 
 func (add *Addon) HandleGetStreams(c *fiber.Ctx) error {
+	records, timedOut, err := add.findStreams(c, nil)
+	if err != nil {
+		return err
+	}
+	add.metrics.StreamResponse(c.Params("type"), len(records), timedOut)
+
 	compiled := regexp.MustCompile(`/stream/(movie|series).+$`)
-	p := pipe.New(add.sourceFromContext(c))
-
-	p.Map(add.fetchMetaInfo)
-	p.FanOut(add.fanOutToAllIndexers)
-	p.Channel(add.searchForTorrents)
-	p.Map(add.parseTorrentTitle)
-	p.Filter(excludeTorrents)
-	p.Shuffle(hasMoreSeeders)
-	p.FanOut(add.enrichInfoHash, pipe.Concurrency[streamRecord](10))
-	p.Filter(deduplicateTorrent())
-	p.Batch(add.enrichWithCachedFiles)
-	p.FanOut(add.locateMediaFile)
-
-	records := add.sinkResults(p)
-	results := make([]StreamItem, 0, maxStreamsResult)
+	results := make([]StreamItem, 0, add.pipelineConfig.MaxStreams)
 	for _, r := range records {
 		results = append(results, StreamItem{
 			Name:  fmt.Sprintf("[%s]", formatResolution(r.TitleInfo.Resolution)),
-			Title: fmt.Sprintf("%s\n%s\n%s | %d | %s", r.Torrent.Title, r.MediaFile.FileName, bytesConvert(r.MediaFile.FileSize), r.Torrent.Seeders, r.Indexer.Name),
+			Title: fmt.Sprintf("%s\n%s\n%s | %d | %s", r.Torrent.Title, r.MediaFile.FileName, bytesConvert(r.MediaFile.FileSize), r.Torrent.Seeders, r.indexerNames()),
 			URL:   r.BaseURL + compiled.ReplaceAllString(c.Path(), "/download/"+r.Torrent.InfoHash+"/"+r.MediaFile.ID),
 			BehaviorHints: &StreamBehaviorHints{
 				VideoSize: r.MediaFile.FileSize,
@@ -210,7 +385,7 @@ func (add *Addon) HandleGetStreams(c *fiber.Ctx) error {
 			},
 		})
 
-		if len(results) == maxStreamsResult {
+		if len(results) == add.pipelineConfig.MaxStreams {
 			break
 		}
 	}
@@ -223,19 +398,70 @@ func (add *Addon) HandleGetStreams(c *fiber.Ctx) error {
 	})
 }
 
-func (add *Addon) sourceFromContext(c *fiber.Ctx) func() ([]*streamRecord, error) {
-	return func() ([]*streamRecord, error) {
-		ipAddress := getIPAddress(c)
+// findStreams runs the stream pipeline of the requested content type and returns the best streams,
+// and whether it timed out before all indexers were searched. Decisions are recorded in explain unless it's nil.
+func (add *Addon) findStreams(c *fiber.Ctx, explain *explainer) ([]*streamRecord, bool, error) {
+	if add.pipelineSlots != nil {
+		select {
+		case add.pipelineSlots <- struct{}{}:
+			defer func() { <-add.pipelineSlots }()
+		default:
+			return nil, false, ratelimit.TooManyRequests(c, pipelineRetryAfter)
+		}
+	}
 
-		userData, err := parseUserData(c)
-		if err != nil {
-			return nil, errors.New("invalid user data")
+	buildPipeline, ok := streamPipelines[ContentType(c.Params("type"))]
+	if !ok {
+		return nil, false, fiber.NewError(fiber.StatusNotFound, "not supported content type")
+	}
+
+	userData, err := add.parseUserData(c)
+	if err != nil {
+		return nil, false, errors.New("invalid user data")
+	}
+
+	// fasthttp doesn't cancel the user context when clients disconnect, so outbound calls
+	// only stop at the timeout or when a middleware cancels the context it sets.
+	ctx, cancel := context.WithTimeout(c.UserContext(), add.pipelineConfig.Timeout)
+	defer cancel()
+
+	// Indexers are searched tier by tier until there are enough good streams.
+	top := pipe.NewTopK(add.pipelineConfig.MaxStreams, cmpLowerQuality)
+	sink := uniqueTorrents(top.Sink)
+	for _, tier := range userData.tiers() {
+		p := pipe.New(ctx, add.streamSource(c, userData, tier, explain), add.pipeOptions(ctx)...)
+		buildPipeline(p, add.streamStages(), add.pipelineConfig)
+		add.sinkResults(ctx, p, sink)
+
+		records := top.Results()
+		if ctx.Err() != nil || len(records) == add.pipelineConfig.MaxStreams && !slices.ContainsFunc(records, isLowQuality) {
+			break
 		}
+	}
+
+	return top.Results(), errors.Is(ctx.Err(), context.DeadlineExceeded), nil
+}
+
+func (add *Addon) pipeOptions(ctx context.Context) []pipe.Option[streamRecord] {
+	opts := []pipe.Option[streamRecord]{pipe.WithTimeout[streamRecord](add.pipelineConfig.Timeout)}
+	if add.newObserver != nil {
+		opts = append(opts, pipe.WithObserver[streamRecord](add.newObserver(ctx)))
+	}
+	return opts
+}
 
-		realDebrid := realdebrid.New(userData.RDAPIKey, ipAddress)
+func (add *Addon) streamSource(c *fiber.Ctx, userData *UserData, tier IndexerPriority, explain *explainer) pipe.Source[streamRecord] {
+	return func(_ context.Context) ([]*streamRecord, error) {
+		ipAddress := getIPAddress(c)
+		realDebrid := add.newRealDebrid(userData.RDAPIKey, ipAddress)
 		prowlarrClient := add.prowlarrClient
 		if userData.ProwlarrAPIKey != "" {
-			prowlarrClient = prowlarr.New(userData.ProwlarrURL, userData.ProwlarrAPIKey)
+			prowlarrClient = prowlarr.New(
+				userData.ProwlarrURL,
+				userData.ProwlarrAPIKey,
+				prowlarr.WithTransport(add.transport),
+				prowlarr.WithCache(add.prowlarrCache),
+			)
 		}
 
 		id := c.Params("id")
@@ -261,238 +487,434 @@ func (add *Addon) sourceFromContext(c *fiber.Ctx) func() ([]*streamRecord, error
 			RemoteAddress: c.Context().RemoteIP().String(),
 			RDClient:      realDebrid,
 			Prowlarr:      prowlarrClient,
+
+			IndexerPriorities: userData.indexerPriorities(),
+			Tier:              tier,
+			Explainer:         explain,
 		}}, nil
 	}
 }
 
-func (add *Addon) fetchMetaInfo(r *streamRecord) (*streamRecord, error) {
-	switch r.ContentType {
-	case ContentTypeMovie:
-		resp, err := add.cinemetaClient.GetMovieById(r.ID)
-		if err != nil {
-			return r, err
-		}
+func (add *Addon) fetchMovieMeta(ctx context.Context, r *streamRecord) (*streamRecord, error) {
+	resp, err := add.metaProvider.GetMovieById(ctx, r.ID)
+	if err != nil {
+		return r, err
+	}
 
-		r.MetaInfo = resp
-		return r, nil
-	case ContentTypeSeries:
-		resp, err := add.cinemetaClient.GetSeriesById(r.ID)
-		if err != nil {
-			return r, err
-		}
+	r.Explainer.setMeta(resp)
+	r.MetaInfo = resp
+	return r, nil
+}
 
-		r.MetaInfo = resp
-		return r, nil
-	default:
-		return r, errors.New("not supported content type")
+func (add *Addon) fetchSeriesMeta(ctx context.Context, r *streamRecord) (*streamRecord, error) {
+	resp, err := add.metaProvider.GetSeriesById(ctx, r.ID, r.Season, r.Episode)
+	if err != nil {
+		return r, err
 	}
+
+	r.Explainer.setMeta(resp)
+	r.MetaInfo = resp
+	return r, nil
 }
 
-func (add *Addon) fanOutToAllIndexers(r *streamRecord) ([]*streamRecord, error) {
-	allIndexers, err := r.Prowlarr.GetAllIndexers()
+func (add *Addon) fanOutToAllIndexers(ctx context.Context, r *streamRecord) ([]*streamRecord, error) {
+	allIndexers, err := r.Prowlarr.GetAllIndexers(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't load all indexers: %v", err)
 	}
 
+	add.updateIndexerStatuses(ctx, r.Prowlarr, allIndexers)
+
 	records := make([]*streamRecord, 0, len(allIndexers))
 	for _, indexer := range allIndexers {
 		if !indexer.Enable {
-			log.Infof("Skip %s as it's disabled", indexer.Name)
+			slog.DebugContext(ctx, "Skipped a disabled indexer", "indexer", indexer.Name)
+			continue
+		}
+
+		priority := PriorityNormal
+		if r.IndexerPriorities != nil {
+			chosen, ok := r.IndexerPriorities[indexer.ID]
+			if !ok {
+				continue
+			}
+			priority = chosen
+		}
+
+		if r.Tier != 0 && priority != r.Tier {
+			continue
+		}
+
+		if !add.indexerHealth.Allow(r.Prowlarr.APIURL(), indexer.ID) {
+			slog.InfoContext(ctx, "Skipped a failing indexer", "indexer", indexer.Name)
 			continue
 		}
 
 		newR := *r
 		newR.Indexer = indexer
+		newR.Priority = priority
 		records = append(records, &newR)
 	}
 
 	return records, nil
 }
 
-func (add *Addon) searchForTorrents(r *streamRecord, stopCh <-chan struct{}, outCh chan<- *streamRecord) error {
-	var torrents []*prowlarr.Torrent
-	var err error
-	totalRecords := 0
+func (add *Addon) searchMovieTorrents(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error {
+	torrents, err := add.searchIndexer(ctx, r, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+		return r.Prowlarr.SearchMovieTorrents(ctx, r.Indexer, r.MetaInfo.Name)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't search %s: %w", r.Indexer.Name, err)
+	}
 
-	isStopped := func() bool {
-		select {
-		case <-stopCh:
-			return true
-		default:
-			return false
-		}
+	sendTorrents(ctx, r, torrents, outCh)
+	totalRecords := len(torrents)
+	totalRecords += add.searchAliases(ctx, r, outCh, func(ctx context.Context, alias string) ([]*prowlarr.Torrent, error) {
+		return r.Prowlarr.SearchMovieTorrents(ctx, r.Indexer, alias)
+	})
+
+	ids := prowlarr.MediaIDs{IMDB: r.MetaInfo.IMDBID, TMDB: r.MetaInfo.TMDBID}
+	if r.Indexer.SupportsMovieIDs(ids) {
+		totalRecords += add.searchIDs(ctx, r, outCh, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+			return r.Prowlarr.SearchMovieTorrentsByID(ctx, r.Indexer, ids)
+		})
 	}
 
-	sendAllRecords := func(torrents []*prowlarr.Torrent) {
+	slog.InfoContext(ctx, "Searched an indexer", "indexer", r.Indexer.Name, "torrents", totalRecords)
+	return nil
+}
+
+func (add *Addon) searchSeriesTorrents(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error {
+	torrents, err := add.searchIndexer(ctx, r, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+		return r.Prowlarr.SearchSeriesTorrents(ctx, r.Indexer, r.MetaInfo.Name)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't search %s: %w", r.Indexer.Name, err)
+	}
+
+	sendTorrents(ctx, r, torrents, outCh)
+	totalRecords := len(torrents)
+	// the indexer may have cut the results, so search the season as well
+	if ctx.Err() == nil && len(torrents) == r.Indexer.Capabilities.LimitDefaults && r.Indexer.Capabilities.LimitDefaults > 0 {
+		torrents, _ = add.searchIndexer(ctx, r, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+			return r.Prowlarr.SearchSeasonTorrents(ctx, r.Indexer, r.MetaInfo.Name, r.Season)
+		})
+		sendTorrents(ctx, r, torrents, outCh)
 		totalRecords += len(torrents)
-		for _, torrent := range torrents {
-			newRecord := *r
-			newRecord.Torrent = torrent
-			pipe.SendRecords([]*streamRecord{&newRecord}, outCh, stopCh)
-			if isStopped() {
-				return
-			}
-		}
 	}
 
-	switch r.ContentType {
-	case ContentTypeMovie:
-		torrents, err = r.Prowlarr.SearchMovieTorrents(r.Indexer, r.MetaInfo.Name)
-		if err != nil {
-			return nil
+	totalRecords += add.searchAliases(ctx, r, outCh, func(ctx context.Context, alias string) ([]*prowlarr.Torrent, error) {
+		return r.Prowlarr.SearchSeriesTorrents(ctx, r.Indexer, alias)
+	})
+
+	ids := prowlarr.MediaIDs{IMDB: r.MetaInfo.IMDBID, TMDB: r.MetaInfo.TMDBID, TVDB: r.MetaInfo.TVDBID}
+	if r.Indexer.SupportsSeriesIDs(ids) {
+		totalRecords += add.searchIDs(ctx, r, outCh, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+			return r.Prowlarr.SearchSeriesTorrentsByID(ctx, r.Indexer, ids)
+		})
+	}
+
+	slog.InfoContext(ctx, "Searched an indexer", "indexer", r.Indexer.Name, "torrents", totalRecords)
+	return nil
+}
+
+// searchAliases searches the aliases of the title as well, since non-English releases are often named after them.
+// It returns the number of torrents found, failures are only logged as the title itself has been searched.
+func (add *Addon) searchAliases(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord, search func(ctx context.Context, alias string) ([]*prowlarr.Torrent, error)) int {
+	totalRecords := 0
+	for i, alias := range r.MetaInfo.Aliases {
+		if i == maxSearchAliases || ctx.Err() != nil {
+			break
 		}
 
-		sendAllRecords(torrents)
-	case ContentTypeSeries:
-		torrents, err = r.Prowlarr.SearchSeriesTorrents(r.Indexer, r.MetaInfo.Name)
+		torrents, err := add.searchIndexer(ctx, r, func(ctx context.Context) ([]*prowlarr.Torrent, error) {
+			return search(ctx, alias)
+		})
 		if err != nil {
-			return nil
+			slog.WarnContext(ctx, "Couldn't search an alias", "indexer", r.Indexer.Name, "alias", alias, "error", err)
+			continue
 		}
 
-		sendAllRecords(torrents)
-		if !isStopped() && len(torrents) == r.Indexer.Capabilities.LimitDefaults && r.Indexer.Capabilities.LimitDefaults > 0 {
-			torrents, _ = r.Prowlarr.SearchSeasonTorrents(r.Indexer, r.MetaInfo.Name, r.Season)
-			sendAllRecords(torrents)
-		}
+		sendTorrents(ctx, r, torrents, outCh)
+		totalRecords += len(torrents)
 	}
 
-	log.Infof("Found %d from %s", totalRecords, r.Indexer.Name)
-	return nil
+	return totalRecords
 }
 
-func (add *Addon) enrichInfoHash(r *streamRecord) ([]*streamRecord, error) {
+// searchIDs searches the indexer by the IDs of the title as well, since it then matches releases by ID instead of by name.
+// It returns the number of torrents found, failures are only logged as the title itself has been searched.
+func (add *Addon) searchIDs(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord, search func(ctx context.Context) ([]*prowlarr.Torrent, error)) int {
+	if ctx.Err() != nil {
+		return 0
+	}
+
+	torrents, err := add.searchIndexer(ctx, r, search)
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't search by IDs", "indexer", r.Indexer.Name, "error", err)
+		return 0
+	}
+
+	sendTorrents(ctx, r, torrents, outCh)
+	return len(torrents)
+}
+
+// searchIndexer runs search against the indexer of r and records the outcome in the indexer health stats and metrics.
+// Searches interrupted because the pipe stopped aren't counted.
+func (add *Addon) searchIndexer(ctx context.Context, r *streamRecord, search func(ctx context.Context) ([]*prowlarr.Torrent, error)) ([]*prowlarr.Torrent, error) {
+	searchCtx, cancel := context.WithTimeout(ctx, indexerSearchTimeout)
+	defer cancel()
+
+	startedAt := time.Now()
+	torrents, err := search(searchCtx)
+	if ctx.Err() == nil {
+		latency := time.Since(startedAt)
+		add.indexerHealth.Record(r.Prowlarr.APIURL(), r.Indexer.ID, r.Indexer.Name, latency, err)
+		add.metrics.IndexerSearch(add.indexerLabel(r), latency, err)
+	}
+
+	return torrents, err
+}
+
+// indexerLabel names the indexer of r in metrics. Only the indexers of the configured Prowlarr are named.
+func (add *Addon) indexerLabel(r *streamRecord) string {
+	if add.prowlarrURL == "" || r.Prowlarr != add.prowlarrClient {
+		return prom.UserIndexer
+	}
+
+	return r.Indexer.Name
+}
+
+// updateIndexerStatuses records which indexers Prowlarr has disabled, so they're skipped.
+func (add *Addon) updateIndexerStatuses(ctx context.Context, client *prowlarr.Prowlarr, indexers []*prowlarr.Indexer) {
+	statuses, err := client.GetIndexerStatuses(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't load indexer statuses", "error", err)
+		return
+	}
+
+	names := make(map[int]string, len(indexers))
+	for _, indexer := range indexers {
+		names[indexer.ID] = indexer.Name
+	}
+
+	for _, status := range statuses {
+		add.indexerHealth.SetDisabledUntil(client.APIURL(), status.IndexerID, names[status.IndexerID], status.DisabledTill)
+	}
+}
+
+// sendTorrents sends a copy of r for every torrent until the pipe is stopped.
+func sendTorrents(ctx context.Context, r *streamRecord, torrents []*prowlarr.Torrent, outCh chan<- *streamRecord) {
+	for _, torrent := range torrents {
+		newRecord := *r
+		newRecord.Torrent = torrent
+		pipe.SendRecords(ctx, []*streamRecord{&newRecord}, outCh)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (add *Addon) enrichInfoHash(ctx context.Context, r *streamRecord) ([]*streamRecord, error) {
 	var err error
 
 	if r.Torrent.InfoHash == "" {
 		infoHash, err := add.cache.Get(r.Torrent.GID)
+		add.metrics.CacheLookup(prom.CacheInfoHash, err == nil)
 		if err == nil {
 			r.Torrent.InfoHash = string(infoHash)
 		}
 	}
 
-	r.Torrent, err = r.Prowlarr.FetchInfoHash(r.Torrent)
+	r.Torrent, err = r.Prowlarr.FetchInfoHash(ctx, r.Torrent)
 	if err != nil {
-		log.Errorf("Failed to fetch InfoHash for %s due to: %v", r.Torrent.Guid, err)
-		return nil, nil
+		r.explainStatus(StatusNoInfoHash, err.Error())
+		return nil, fmt.Errorf("couldn't fetch InfoHash for %s: %w", r.Torrent.Guid, err)
 	}
 
 	if r.Torrent.InfoHash == "" {
-		log.Warnf("Unable to find InfoHash for %s", r.Torrent.Guid)
-		return nil, nil
+		r.explainStatus(StatusNoInfoHash, "")
+		return nil, fmt.Errorf("no InfoHash for %s", r.Torrent.Guid)
 	}
+	// clears the failure of a previous attempt
+	r.explainStatus("", "")
 
 	err = add.cache.Set(r.Torrent.GID, []byte(r.Torrent.InfoHash), infoHashCacheExpiry)
 	if err != nil {
-		log.Errorf("Failed to cache the InfoHash due to: %v", err)
-		return nil, nil
+		slog.WarnContext(ctx, "Failed to cache the InfoHash", "error", err)
 	}
 
 	return []*streamRecord{r}, nil
 }
 
-func (add *Addon) enrichWithCachedFiles(records []*streamRecord) ([]*streamRecord, error) {
+func (add *Addon) enrichWithCachedFiles(ctx context.Context, records []*streamRecord) ([]*streamRecord, error) {
 	infoHashs := make([]string, 0, len(records))
 	for _, record := range records {
 		if record.Torrent.InfoHash == "" {
-			log.Infof("Skipped %s due to missing infoHash", record.Torrent.Title)
+			slog.DebugContext(ctx, "Skipped a torrent without InfoHash", "title", record.Torrent.Title)
 			continue
 		}
 
 		infoHashs = append(infoHashs, record.Torrent.InfoHash)
 	}
 
-	filesByHash, err := records[0].RDClient.GetFiles(infoHashs)
+	filesByHash, err := records[0].RDClient.GetFiles(ctx, infoHashs)
 	if err != nil {
-		log.Errorf("Failed to fetch files from debrid: %v", err)
-		return nil, nil
+		return nil, fmt.Errorf("couldn't fetch files from debrid: %w", err)
 	}
 
 	cachedRecords := make([]*streamRecord, 0, len(records))
 	for _, r := range records {
-		if files, ok := filesByHash[r.Torrent.InfoHash]; ok {
+		files, ok := filesByHash[r.Torrent.InfoHash]
+		r.explain(func(candidate *ExplainCandidate) {
+			candidate.Cached = &ok
+			if !ok {
+				candidate.Status = StatusNotCached
+			}
+		})
+
+		if ok {
 			newR := *r
 			newR.Files = files
 			cachedRecords = append(cachedRecords, &newR)
-			// } else {
-			// 	log.Infof("Skipped %s due to missing cached file", r.Torrent.Title)
 		}
 	}
 
-	log.Infof("Found %d cached from %d records", len(cachedRecords), len(records))
+	slog.InfoContext(ctx, "Checked cached torrents", "cached", len(cachedRecords), "torrents", len(records))
 	return cachedRecords, nil
 }
 
-func (add *Addon) sinkResults(p *pipe.Pipe[streamRecord]) []*streamRecord {
-	records := []*streamRecord{}
+func (add *Addon) sinkResults(ctx context.Context, p *pipe.Pipe[streamRecord], sink pipe.Sink[streamRecord]) {
 	err := p.Sink(func(r *streamRecord) error {
-		records = append(records, r)
-		return nil
+		r.explain(func(candidate *ExplainCandidate) {
+			candidate.Score = &ExplainScore{
+				Resolution: r.TitleInfo.Resolution,
+				Priority:   r.priority(),
+				FileSize:   r.MediaFile.FileSize,
+			}
+		})
+		return sink(r)
 	})
 
-	if err != nil {
-		log.Errorf("Error while processing: %v", err)
+	if pipe.IsSkipped(err) {
+		slog.WarnContext(ctx, "Some records were skipped while processing", "error", err)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Error while processing", "error", err)
 	}
+}
+
+// uniqueTorrents passes every torrent to sink once, as tiers are searched by separate pipelines
+// which can find the same torrent. The first tier to find it wins.
+func uniqueTorrents(sink pipe.Sink[streamRecord]) pipe.Sink[streamRecord] {
+	seen := map[string]bool{}
+	return func(r *streamRecord) error {
+		key := torrentKey(r)
+		if seen[key] {
+			return nil
+		}
 
-	slices.SortFunc(records, cmpLowerQuality)
-	return records
+		seen[key] = true
+		return sink(r)
+	}
 }
 
-func (add *Addon) parseTorrentTitle(r *streamRecord) (*streamRecord, error) {
+func parseTorrentTitle(_ context.Context, r *streamRecord) (*streamRecord, error) {
 	r.TitleInfo = titleparser.Parse(r.Torrent.Title)
 	return r, nil
 }
 
-func (add *Addon) locateMediaFile(r *streamRecord) ([]*streamRecord, error) {
-	switch r.ContentType {
-	case ContentTypeMovie:
-		r.MediaFile = findMovieMediaFile(r.Files)
-	case ContentTypeSeries:
-		// Season & Episode together
-		r.MediaFile = findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)(\b|_)S?(%d|%02d)[x\.\-]?E?%02d(\b|_)`, r.Season, r.Season, r.Episode))
+func locateMovieFile(ctx context.Context, r *streamRecord) ([]*streamRecord, error) {
+	return withMediaFile(ctx, r, findMovieMediaFile(r.Files)), nil
+}
 
-		if r.MediaFile == nil {
-			// Season & Episode are separate
-			r.MediaFile = findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)\bS?%02d\b.+\bE?%02d\b`, r.Season, r.Episode))
-		}
+func locateEpisodeFile(ctx context.Context, r *streamRecord) ([]*streamRecord, error) {
+	// Season & Episode together
+	mediaFile := findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)(\b|_)S?(%d|%02d)[x\.\-]?E?%02d(\b|_)`, r.Season, r.Season, r.Episode))
 
-		if r.MediaFile == nil {
-			// Episode only
-			r.MediaFile = findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)\bE?(%d|%02d)\b`, r.Episode, r.Episode))
-		}
-	default:
-		return nil, errors.New("invalid content type")
+	if mediaFile == nil {
+		// Season & Episode are separate
+		mediaFile = findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)\bS?%02d\b.+\bE?%02d\b`, r.Season, r.Episode))
 	}
 
-	if r.MediaFile == nil {
-		log.Infof("Couldn't locate media file: %s, %d, %d", r.Torrent.Title, r.Season, r.Episode)
-		// for _, f := range r.Files {
-		// 	log.Infof("File %s, %s", f.ID, f.FileName)
-		// }
-		return nil, nil
+	if mediaFile == nil {
+		// Episode only
+		mediaFile = findEpisodeMediaFile(r.Files, fmt.Sprintf(`(?i)\bE?(%d|%02d)\b`, r.Episode, r.Episode))
 	}
 
-	if r.MediaFile.FileSize >= maxSizeInBytes {
-		return nil, nil
+	return withMediaFile(ctx, r, mediaFile), nil
+}
+
+// withMediaFile keeps r if the media file was found and isn't too big to stream.
+func withMediaFile(ctx context.Context, r *streamRecord, mediaFile *realdebrid.File) []*streamRecord {
+	if mediaFile == nil {
+		slog.DebugContext(ctx, "Couldn't locate the media file", "title", r.Torrent.Title, "season", r.Season, "episode", r.Episode)
+		r.explainStatus(StatusNoMediaFile, "")
+		return nil
 	}
 
-	return []*streamRecord{r}, nil
+	r.explain(func(candidate *ExplainCandidate) {
+		candidate.MediaFile = mediaFile
+	})
+	if mediaFile.FileSize >= maxSizeInBytes {
+		r.explainStatus(StatusTooBig, "")
+		return nil
+	}
+
+	r.MediaFile = mediaFile
+	return []*streamRecord{r}
 }
 
-func deduplicateTorrent() func(r *streamRecord) bool {
-	found := &sync.Map{}
-	return func(r *streamRecord) bool {
-		if r.Torrent.InfoHash == "" {
-			log.Infof("Skipped %s due to empty hash", r.Torrent.Title)
-			return false
-		}
+func torrentKey(r *streamRecord) string {
+	return r.Torrent.InfoHash
+}
 
-		if _, loaded := found.LoadOrStore(r.Torrent.InfoHash, struct{}{}); loaded {
-			log.Infof("Skipped %s due to duplication of %s", r.Torrent.Title, r.Torrent.InfoHash)
-			return false
+// mergeTorrents combines records of the same torrent found by different indexers.
+// The record with more seeders is kept and the indexers of both are listed.
+func mergeTorrents(ctx context.Context, kept, r *streamRecord) *streamRecord {
+	slog.DebugContext(ctx, "Merged duplicated torrents", "title", r.Torrent.Title, "into", kept.Torrent.Title, "info_hash", r.Torrent.InfoHash)
+	indexers := kept.allIndexers()
+	for _, indexer := range r.allIndexers() {
+		if !slices.ContainsFunc(indexers, func(i *prowlarr.Indexer) bool { return i.ID == indexer.ID }) {
+			indexers = append(indexers, indexer)
 		}
+	}
 
-		return true
+	priority := min(kept.priority(), r.priority())
+	if r.Torrent.Seeders > kept.Torrent.Seeders {
+		kept = r
+	}
+
+	kept.Indexers = indexers
+	kept.Priority = priority
+	// duplicates share the candidate of kept, which is found by all their indexers
+	kept.explain(func(candidate *ExplainCandidate) {
+		candidate.Title = kept.Torrent.Title
+		candidate.Indexer = kept.indexerNames()
+		candidate.Seeders = kept.Torrent.Seeders
+	})
+	return kept
+}
+
+func (r *streamRecord) allIndexers() []*prowlarr.Indexer {
+	if len(r.Indexers) > 0 {
+		return r.Indexers
 	}
+
+	return []*prowlarr.Indexer{r.Indexer}
+}
+
+func (r *streamRecord) priority() IndexerPriority {
+	return r.Priority.normalize()
+}
+
+func (r *streamRecord) indexerNames() string {
+	indexers := r.allIndexers()
+	names := make([]string, 0, len(indexers))
+	for _, indexer := range indexers {
+		names = append(names, indexer.Name)
+	}
+
+	return strings.Join(names, ", ")
 }
 
 func findEpisodeMediaFile(files []*realdebrid.File, pattern string) *realdebrid.File {
@@ -537,32 +959,78 @@ func hasMediaExtension(fileName string) bool {
 	return false
 }
 
-func excludeTorrents(r *streamRecord) bool {
-	qualityOK := !slices.Contains(remuxSources, r.TitleInfo.Quality) &&
-		!slices.Contains(camSources, r.TitleInfo.Quality) && !r.TitleInfo.ThreeD
-	imdbOK := (r.Torrent.Imdb == 0 || r.Torrent.Imdb == r.MetaInfo.IMDBID)
-	yearOK := (r.TitleInfo.Year == 0 || (r.MetaInfo.FromYear <= r.TitleInfo.Year && r.MetaInfo.ToYear >= r.TitleInfo.Year))
-	seasonOK := r.ContentType != ContentTypeSeries || (r.TitleInfo.FromSeason == 0 || (r.TitleInfo.FromSeason <= r.Season && r.TitleInfo.ToSeason >= r.Season))
-	episodeOK := r.ContentType != ContentTypeSeries || (r.TitleInfo.Episode == 0 || r.TitleInfo.Episode == r.Episode)
-	torrentOK := qualityOK && imdbOK && yearOK && seasonOK && episodeOK
-	if torrentOK && r.Torrent.Imdb == 0 {
-		diff := checkTitleSimilarity(r.MetaInfo.Name, r.TitleInfo.Title)
-		torrentOK = torrentOK && diff < maxTitleDistance
-		if !torrentOK && (diff < maxTitleDistance+3) {
-			log.Infof("Excluded %s, title: %s, diff: %d", r.Torrent.Title, r.TitleInfo.Title, diff)
+func excludeTorrents(ctx context.Context, r *streamRecord) bool {
+	decision := filterTorrent(r)
+	if !decision.Kept && decision.TitleDistance >= maxTitleDistance && decision.TitleDistance < maxTitleDistance+3 {
+		slog.DebugContext(ctx, "Excluded a torrent with a similar title", "title", r.Torrent.Title, "parsed_title", r.TitleInfo.Title, "distance", decision.TitleDistance)
+	}
+	r.explain(func(candidate *ExplainCandidate) {
+		candidate.Filters = &decision
+		if !decision.Kept {
+			candidate.Status = StatusExcluded
+		}
+	})
+
+	return decision.Kept
+}
+
+// filterTorrent checks the title of a torrent against the requested title.
+func filterTorrent(r *streamRecord) FilterDecision {
+	decision := FilterDecision{
+		Quality: !slices.Contains(remuxSources, r.TitleInfo.Quality) &&
+			!slices.Contains(camSources, r.TitleInfo.Quality) && !r.TitleInfo.ThreeD,
+		IMDb:          (r.Torrent.Imdb == 0 || r.Torrent.Imdb == r.MetaInfo.IMDBID),
+		TVDB:          (r.Torrent.TVDBId == 0 || r.MetaInfo.TVDBID == 0 || r.Torrent.TVDBId == r.MetaInfo.TVDBID),
+		Year:          matchesYear(r),
+		Season:        r.ContentType != ContentTypeSeries || (r.TitleInfo.FromSeason == 0 || (r.TitleInfo.FromSeason <= r.Season && r.TitleInfo.ToSeason >= r.Season)),
+		Episode:       r.ContentType != ContentTypeSeries || (r.TitleInfo.Episode == 0 || r.TitleInfo.Episode == r.Episode),
+		TitleDistance: -1,
+	}
+	decision.Kept = decision.Quality && decision.IMDb && decision.TVDB && decision.Year && decision.Season && decision.Episode
+
+	idMatched := r.Torrent.Imdb != 0 || (r.Torrent.TVDBId != 0 && r.MetaInfo.TVDBID != 0)
+	if decision.Kept && !idMatched {
+		decision.TitleDistance = titleDistance(r.MetaInfo, r.TitleInfo.Title)
+		decision.Kept = decision.TitleDistance < maxTitleDistance
+	}
+
+	return decision
+}
+
+// matchesYear checks the year in the torrent title. Series spanning many years are named after
+// either their first year or the year the episode, or its season, was aired when it's known.
+func matchesYear(r *streamRecord) bool {
+	year := r.TitleInfo.Year
+	if year == 0 {
+		return true
+	}
+
+	if r.ContentType == ContentTypeSeries && r.MetaInfo.EpisodeYear != 0 {
+		return year == r.MetaInfo.FromYear || (year >= r.MetaInfo.EpisodeYear-1 && year <= r.MetaInfo.EpisodeYear)
+	}
+
+	return r.MetaInfo.FromYear <= year && r.MetaInfo.ToYear >= year
+}
+
+func isGoodQuality(r *streamRecord) bool {
+	return r.TitleInfo.Resolution >= minGoodResolution
+}
+
+func isLowQuality(r *streamRecord) bool {
+	return !isGoodQuality(r)
+}
+
+// titleDistance returns the distance between title and the closest title of meta, including its aliases.
+func titleDistance(meta *model.MetaInfo, title string) int {
+	distance := -1
+	for _, metaTitle := range meta.Titles() {
+		diff := checkTitleSimilarity(metaTitle, title)
+		if distance < 0 || diff < distance {
+			distance = diff
 		}
 	}
 
-	// if !torrentOK {
-	// 	log.Infof("Excluded %s, quality: %v, imdb: %v, year: %v, season: %v, episode: %v",
-	// 		r.Torrent.Title,
-	// 		qualityOK,
-	// 		imdbOK, yearOK,
-	// 		seasonOK,
-	// 		episodeOK,
-	// 	)
-	// }
-	return torrentOK
+	return distance
 }
 
 func checkTitleSimilarity(left, right string) int {
@@ -606,6 +1074,11 @@ func cmpLowerQuality(r1, r2 *streamRecord) int {
 		return 1
 	}
 
+	// torrents from trusted indexers first
+	if r1.priority() != r2.priority() {
+		return int(r1.priority() - r2.priority())
+	}
+
 	if r1.MediaFile.FileSize > r2.MediaFile.FileSize {
 		return -1
 	}
@@ -617,31 +1090,61 @@ func cmpLowerQuality(r1, r2 *streamRecord) int {
 	return 0
 }
 
+// getIPAddress returns the client IP forwarded by a trusted proxy, if any.
 func getIPAddress(c *fiber.Ctx) string {
-	ips := c.GetReqHeaders()["Cf-Connecting-Ip"]
-	if len(ips) > 0 {
-		return ips[0]
+	if ip := c.IP(); ip != c.Context().RemoteIP().String() {
+		return ip
 	}
 
 	return ""
 }
 
-func parseUserData(c *fiber.Ctx) (*UserData, error) {
+// RateLimitKey is a ratelimit.KeyFunc which counts requests against the RD account of the user.
+// Tokens which can't be decoded aren't counted, so made-up tokens don't get buckets of their own.
+func (add *Addon) RateLimitKey(c *fiber.Ctx) string {
+	userData, err := add.parseUserData(c)
+	if err != nil || userData.RDAPIKey == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(userData.RDAPIKey))
+	return "user:" + hex.EncodeToString(sum[:16])
+}
+
+// parseUserData decodes the user data of the request once, later calls reuse it.
+func (add *Addon) parseUserData(c *fiber.Ctx) (*UserData, error) {
+	if userData, ok := c.Locals(userDataLocal).(*UserData); ok {
+		return userData, nil
+	}
+
+	userData, err := add.decodeUserData(c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Locals(userDataLocal, userData)
+	return userData, nil
+}
+
+func (add *Addon) decodeUserData(c *fiber.Ctx) (*UserData, error) {
 	userDataRaw := c.Params("userData")
 	if userDataRaw == "" {
 		return nil, errors.New("configuration is required")
 	}
 
-	userDataJson, err := url.PathUnescape(userDataRaw)
-	if err != nil {
-		log.Errorf("Failed base64 decode userdata %s: %v", userDataRaw, err)
-		return nil, errors.New("invalid userData")
+	if add.profileStore != nil && profile.IsID(userDataRaw) {
+		data, err := add.profileStore.Get(c.UserContext(), userDataRaw)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to load the profile", "error", err)
+			return nil, errors.New("invalid userData")
+		}
+
+		userDataRaw = data
 	}
 
-	userData := &UserData{}
-	err = json.Unmarshal([]byte(userDataJson), userData)
+	userData, err := add.userDataCodec.decode(userDataRaw)
 	if err != nil {
-		log.Errorf("Failed base64 decode userdata %s: %v", userDataRaw, err)
+		slog.WarnContext(c.UserContext(), "Failed to decode userData", "error", err)
 		return nil, errors.New("invalid userData")
 	}
 
@@ -1,11 +1,29 @@
 package addon
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/bongnv/prowlarr-stremio/internal/cinemeta"
 	"github.com/bongnv/prowlarr-stremio/internal/debrid/realdebrid"
+	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/bongnv/prowlarr-stremio/internal/profile"
+	"github.com/bongnv/prowlarr-stremio/internal/prom"
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/proxy"
+	"github.com/bongnv/prowlarr-stremio/internal/titleparser"
+	"github.com/coocood/freecache"
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,6 +33,16 @@ func TestTitleCheck(t *testing.T) {
 	require.True(t, checkTitleSimilarity("House", "House_-_") < maxTitleDistance)
 	require.True(t, checkTitleSimilarity("Mad Max: Fury Road", "Mad Max Fury Road") < maxTitleDistance)
 	require.True(t, checkTitleSimilarity("House", "House M D") < maxTitleDistance)
+
+	meta := &model.MetaInfo{Name: "Spirited Away", Aliases: []string{"Sen to Chihiro no Kamikakushi"}}
+	require.True(t, titleDistance(meta, "Sen to Chihiro no Kamikakushi") < maxTitleDistance)
+	require.True(t, titleDistance(meta, "Spirited Away") < maxTitleDistance)
+	require.True(t, titleDistance(meta, "Howl's Moving Castle") > maxTitleDistance)
+
+	// titles of other regions aren't aliases, so they don't match
+	meta = &model.MetaInfo{Name: "Spirited Away", Aliases: []string{"千と千尋の神隠し", "Le Voyage de Chihiro"}}
+	require.True(t, titleDistance(meta, "Le Voyage de Chihiro") < maxTitleDistance)
+	require.True(t, titleDistance(meta, "Chihiros Reise ins Zauberland") > maxTitleDistance)
 }
 
 func Test_Encoding(t *testing.T) {
@@ -29,8 +57,6 @@ func Test_Encoding(t *testing.T) {
 }
 
 func Test_FindingEpisodeFile(t *testing.T) {
-	add := &Addon{}
-
 	testCases := map[string]struct {
 		r *streamRecord
 	}{
@@ -96,7 +122,7 @@ func Test_FindingEpisodeFile(t *testing.T) {
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
 			require.NotPanics(t, func() {
-				result, err := add.locateMediaFile(tc.r)
+				result, err := locateEpisodeFile(context.Background(), tc.r)
 				require.NoError(t, err)
 				require.Len(t, result, 1)
 				require.Equal(t, "match", result[0].MediaFile.ID)
@@ -104,3 +130,296 @@ func Test_FindingEpisodeFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_UserDataCodec(t *testing.T) {
+	userData := &UserData{
+		RDAPIKey:       "RD API TOKEN",
+		ProwlarrURL:    "http://prowlarr:9696",
+		ProwlarrAPIKey: "PROWLARR API KEY",
+	}
+	plainToken := url.PathEscape(`{"rd":"RD API TOKEN"}`)
+
+	t.Run("should round trip encrypted tokens", func(t *testing.T) {
+		codec, err := newUserDataCodec("secret", false)
+		require.NoError(t, err)
+
+		token, err := codec.encode(userData)
+		require.NoError(t, err)
+		require.NotContains(t, token, userData.RDAPIKey)
+
+		decoded, err := codec.decode(token)
+		require.NoError(t, err)
+		require.Equal(t, userData, decoded)
+	})
+
+	t.Run("should reject tampered tokens", func(t *testing.T) {
+		codec, err := newUserDataCodec("secret", true)
+		require.NoError(t, err)
+
+		token, err := codec.encode(userData)
+		require.NoError(t, err)
+		tampered := []byte(token)
+		tampered[len(tampered)-1] ^= 1
+		_, err = codec.decode(string(tampered))
+		require.Error(t, err)
+
+		otherCodec, err := newUserDataCodec("another secret", false)
+		require.NoError(t, err)
+		_, err = otherCodec.decode(token)
+		require.Error(t, err)
+	})
+
+	t.Run("should only accept plain JSON when allowed", func(t *testing.T) {
+		strictCodec, err := newUserDataCodec("secret", false)
+		require.NoError(t, err)
+		_, err = strictCodec.decode(plainToken)
+		require.Error(t, err)
+
+		compatCodec, err := newUserDataCodec("secret", true)
+		require.NoError(t, err)
+		decoded, err := compatCodec.decode(plainToken)
+		require.NoError(t, err)
+		require.Equal(t, "RD API TOKEN", decoded.RDAPIKey)
+	})
+
+	t.Run("should use plain JSON without a secret", func(t *testing.T) {
+		codec, err := newUserDataCodec("", false)
+		require.NoError(t, err)
+
+		token, err := codec.encode(userData)
+		require.NoError(t, err)
+		decoded, err := codec.decode(token)
+		require.NoError(t, err)
+		require.Equal(t, userData, decoded)
+	})
+}
+
+func Test_MergeTorrents(t *testing.T) {
+	first := &streamRecord{
+		Indexer: &prowlarr.Indexer{ID: 1, Name: "first"},
+		Torrent: &prowlarr.Torrent{Title: "Movie 1080p", InfoHash: "hash", Seeders: 5},
+	}
+	second := &streamRecord{
+		Indexer: &prowlarr.Indexer{ID: 2, Name: "second"},
+		Torrent: &prowlarr.Torrent{Title: "Movie.1080p", InfoHash: "hash", Seeders: 10},
+	}
+	again := &streamRecord{
+		Indexer: &prowlarr.Indexer{ID: 1, Name: "first"},
+		Torrent: &prowlarr.Torrent{Title: "Movie 1080p", InfoHash: "hash", Seeders: 1},
+	}
+
+	ctx := context.Background()
+	merged := mergeTorrents(ctx, mergeTorrents(ctx, first, second), again)
+	require.Same(t, second, merged)
+	require.Equal(t, "first, second", merged.indexerNames())
+}
+
+func Test_IndexerTiers(t *testing.T) {
+	t.Run("should search all indexers at once by default", func(t *testing.T) {
+		userData := &UserData{}
+		require.Nil(t, userData.indexerPriorities())
+		require.Equal(t, []IndexerPriority{0}, userData.tiers())
+	})
+
+	t.Run("should search tiers by priority", func(t *testing.T) {
+		userData := &UserData{
+			Indexers: []IndexerPreference{
+				{ID: 1, Priority: PriorityLow},
+				{ID: 2, Priority: PriorityHigh},
+				{ID: 3},
+			},
+		}
+		require.Equal(t, map[int]IndexerPriority{1: PriorityLow, 2: PriorityHigh, 3: PriorityNormal}, userData.indexerPriorities())
+		require.Equal(t, []IndexerPriority{PriorityHigh, PriorityNormal, PriorityLow}, userData.tiers())
+	})
+
+	t.Run("should rank trusted indexers first at the same resolution", func(t *testing.T) {
+		trusted := &streamRecord{
+			TitleInfo: &titleparser.MetaInfo{Resolution: 1080},
+			MediaFile: &realdebrid.File{FileSize: 1},
+			Priority:  PriorityHigh,
+		}
+		bigger := &streamRecord{
+			TitleInfo: &titleparser.MetaInfo{Resolution: 1080},
+			MediaFile: &realdebrid.File{FileSize: 2},
+		}
+		require.Negative(t, cmpLowerQuality(trusted, bigger))
+	})
+}
+
+func Test_MatchesYear(t *testing.T) {
+	series := &model.MetaInfo{FromYear: 2005, ToYear: 2022}
+	episode := &model.MetaInfo{FromYear: 2005, ToYear: 2022, EpisodeYear: 2006}
+	testCases := map[string]struct {
+		meta     *model.MetaInfo
+		year     int
+		expected bool
+	}{
+		"should accept titles without a year":     {meta: episode, year: 0, expected: true},
+		"should accept any year of the series":    {meta: series, year: 2015, expected: true},
+		"should accept the first year":            {meta: episode, year: 2005, expected: true},
+		"should accept the year of the episode":   {meta: episode, year: 2006, expected: true},
+		"should reject other years of the series": {meta: episode, year: 2015, expected: false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := &streamRecord{
+				ContentType: ContentTypeSeries,
+				MetaInfo:    tc.meta,
+				TitleInfo:   &titleparser.MetaInfo{Year: tc.year},
+			}
+			require.Equal(t, tc.expected, matchesYear(r))
+		})
+	}
+}
+
+func TestHandleSaveProfile(t *testing.T) {
+	store, err := profile.Open(filepath.Join(t.TempDir(), "profiles.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	add := New(WithUserDataSecret("secret", false), WithProfileStore(store))
+	app := fiber.New()
+	app.Post("/profile", add.HandleSaveProfile)
+
+	save := func(body string) ProfileResponse {
+		req := httptest.NewRequest(fiber.MethodPost, "/profile", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+		result := ProfileResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	created := save(`{"rd":"token-1"}`)
+	require.True(t, profile.IsID(created.ID))
+
+	t.Run("should update the profile posted in the body", func(t *testing.T) {
+		updated := save(`{"rd":"token-2","profileId":"` + created.ID + `"}`)
+		require.Equal(t, created.ID, updated.ID)
+
+		data, err := store.Get(context.Background(), created.ID)
+		require.NoError(t, err)
+		userData, err := add.userDataCodec.decode(data)
+		require.NoError(t, err)
+		require.Equal(t, "token-2", userData.RDAPIKey)
+	})
+
+	t.Run("should create a profile if the posted one doesn't exist", func(t *testing.T) {
+		other := save(`{"rd":"token-3","profileId":"00000000000000000000000000000000"}`)
+		require.NotEqual(t, created.ID, other.ID)
+	})
+}
+
+func TestHandleDownload_BadUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "link expired", http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	add := New(WithStreamProxy(proxy.New()))
+	cacheKey := []byte("token" + "abc" + "1")
+	require.NoError(t, add.cache.Set(cacheKey, []byte(upstream.URL), downloadURLExpiry))
+
+	app := fiber.New()
+	app.Get("/:userData/download/:infoHash/:fileID", add.HandleDownload)
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/"+url.PathEscape(`{"rd":"token"}`)+"/download/abc/1", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, err = add.cache.Get(cacheKey)
+	require.ErrorIs(t, err, freecache.ErrNotFound)
+}
+
+func TestHandleGetStreams_Cancellation(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	calls := atomic.Int32{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		call := calls.Add(1)
+		if call == 1 {
+			close(started)
+		}
+		<-r.Context().Done()
+		if call == 1 {
+			close(aborted)
+		}
+	}))
+	defer upstream.Close()
+
+	add := New(WithMetaProvider(cinemeta.New(cinemeta.WithBaseURL(upstream.URL))))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(ctx)
+		return c.Next()
+	})
+	app.Get("/:userData/stream/:type/:id.json", add.HandleGetStreams)
+
+	done := make(chan error, 1)
+	go func() {
+		req := httptest.NewRequest(fiber.MethodGet, "/"+url.PathEscape(`{"rd":"token"}`)+"/stream/movie/tt1.json", nil)
+		_, err := app.Test(req, -1)
+		done <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream wasn't called")
+	}
+	cancel()
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream call wasn't aborted")
+	}
+	require.NoError(t, <-done)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestRateLimitKey(t *testing.T) {
+	add := New(WithUserDataSecret("secret", false))
+	app := fiber.New()
+	app.Get("/:userData/stream", func(c *fiber.Ctx) error {
+		return c.SendString(add.RateLimitKey(c))
+	})
+
+	key := func(token string) string {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/"+token+"/stream", nil))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	first, err := add.userDataCodec.encode(&UserData{RDAPIKey: "rd-key"})
+	require.NoError(t, err)
+	second, err := add.userDataCodec.encode(&UserData{RDAPIKey: "rd-key", ProwlarrURL: "http://prowlarr:9696"})
+	require.NoError(t, err)
+
+	require.NotEmpty(t, key(first))
+	require.NotContains(t, key(first), "rd-key")
+	require.Equal(t, key(first), key(second))
+	require.Empty(t, key("made-up-token"))
+}
+
+func TestIndexerLabel(t *testing.T) {
+	add := New(WithProwlarr("http://prowlarr:9696", "key"))
+	indexer := &prowlarr.Indexer{ID: 1, Name: "indexer"}
+
+	require.Equal(t, "indexer", add.indexerLabel(&streamRecord{Prowlarr: add.prowlarrClient, Indexer: indexer}))
+
+	userClient := prowlarr.New("http://user-prowlarr:9696", "user-key")
+	require.Equal(t, prom.UserIndexer, add.indexerLabel(&streamRecord{Prowlarr: userClient, Indexer: indexer}))
+
+	withoutProwlarr := New()
+	require.Equal(t, prom.UserIndexer, withoutProwlarr.indexerLabel(&streamRecord{Prowlarr: withoutProwlarr.prowlarrClient, Indexer: indexer}))
+}
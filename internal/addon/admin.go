@@ -0,0 +1,17 @@
+package addon
+
+import (
+	"github.com/bongnv/prowlarr-stremio/internal/health"
+	"github.com/gofiber/fiber/v2"
+)
+
+type IndexerHealthResponse struct {
+	Indexers []health.IndexerStats `json:"indexers"`
+}
+
+// HandleIndexerHealth lists the health stats of the indexers queried so far. It's meant for admins only.
+func (add *Addon) HandleIndexerHealth(c *fiber.Ctx) error {
+	return c.JSON(IndexerHealthResponse{
+		Indexers: add.indexerHealth.Snapshot(),
+	})
+}
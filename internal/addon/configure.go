@@ -0,0 +1,130 @@
+package addon
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/static"
+	"github.com/gofiber/fiber/v2"
+)
+
+const validateTimeout = 10 * time.Second
+
+type ValidateResponse struct {
+	RealDebrid RealDebridStatus `json:"realDebrid"`
+	Prowlarr   ProwlarrStatus   `json:"prowlarr"`
+}
+
+type RealDebridStatus struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Username string `json:"username,omitempty"`
+	Premium  bool   `json:"premium"`
+}
+
+type ProwlarrStatus struct {
+	OK       bool            `json:"ok"`
+	Error    string          `json:"error,omitempty"`
+	Indexers []IndexerStatus `json:"indexers"`
+}
+
+type IndexerStatus struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// HandleConfigure renders the configure page, pre-filled with the current configuration if there is one.
+func (add *Addon) HandleConfigure(c *fiber.Ctx) error {
+	page := static.ConfigurePage{
+		Version: add.version,
+	}
+
+	if c.Params("userData") != "" {
+		userData, err := add.parseUserData(c)
+		if err != nil {
+			slog.WarnContext(c.UserContext(), "Couldn't pre-fill the configure page", "error", err)
+		} else {
+			page.RDAPIKey = userData.RDAPIKey
+			page.ProwlarrURL = userData.ProwlarrURL
+			page.ProwlarrAPIKey = userData.ProwlarrAPIKey
+			page.Indexers = userData.Indexers
+		}
+	}
+
+	return static.RenderConfigure(c, page)
+}
+
+// HandleValidate checks the credentials of a configuration before it's installed.
+func (add *Addon) HandleValidate(c *fiber.Ctx) error {
+	userData := &UserData{}
+	if err := c.BodyParser(userData); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid configuration")
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), validateTimeout)
+	defer cancel()
+
+	return c.JSON(ValidateResponse{
+		RealDebrid: add.validateRealDebrid(ctx, userData.RDAPIKey),
+		Prowlarr:   add.validateProwlarr(ctx, userData),
+	})
+}
+
+func (add *Addon) validateRealDebrid(ctx context.Context, apiKey string) RealDebridStatus {
+	if apiKey == "" {
+		return RealDebridStatus{Error: "missing API token"}
+	}
+
+	user, err := add.newRealDebrid(apiKey, "").GetUser(ctx)
+	if err != nil {
+		return RealDebridStatus{Error: "invalid API token"}
+	}
+
+	return RealDebridStatus{
+		OK:       true,
+		Username: user.Username,
+		Premium:  user.Type == "premium",
+	}
+}
+
+func (add *Addon) validateProwlarr(ctx context.Context, userData *UserData) ProwlarrStatus {
+	client := add.prowlarrClient
+	if userData.ProwlarrAPIKey != "" {
+		client = prowlarr.New(userData.ProwlarrURL, userData.ProwlarrAPIKey, prowlarr.WithTransport(add.transport))
+	} else if add.prowlarrURL == "" {
+		return ProwlarrStatus{Error: "missing API key"}
+	}
+
+	indexers, err := client.GetAllIndexers(ctx)
+	if err != nil {
+		slog.InfoContext(ctx, "Prowlarr validation failed", "error", err)
+		return ProwlarrStatus{Error: prowlarrErrorMessage(err)}
+	}
+
+	enabled := []IndexerStatus{}
+	for _, indexer := range indexers {
+		if indexer.Enable {
+			enabled = append(enabled, IndexerStatus{
+				ID:   indexer.ID,
+				Name: indexer.Name,
+			})
+		}
+	}
+
+	return ProwlarrStatus{
+		OK:       true,
+		Indexers: enabled,
+	}
+}
+
+// prowlarrErrorMessage describes why Prowlarr couldn't be reached without leaking internal details.
+func prowlarrErrorMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out"
+	}
+
+	return "couldn't reach Prowlarr or the API key is invalid"
+}
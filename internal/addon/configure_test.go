@@ -0,0 +1,112 @@
+package addon
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteTransport sends every request to target, so clients with a fixed base URL can be faked.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHandleConfigure(t *testing.T) {
+	add := New(WithVersion("1.2.3"), WithUserDataSecret("secret", false))
+	app := fiber.New()
+	app.Get("/configure", add.HandleConfigure)
+	app.Get("/:userData/configure", add.HandleConfigure)
+
+	t.Run("should render the version and defaults", func(t *testing.T) {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/configure", nil))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		require.Contains(t, string(body), "v1.2.3")
+		require.Contains(t, string(body), `value="http://prowlarr:9696"`)
+		require.Equal(t, "max-age=86400, public", resp.Header.Get(fiber.HeaderCacheControl))
+	})
+
+	t.Run("should pre-fill the existing configuration", func(t *testing.T) {
+		token, err := add.userDataCodec.encode(&UserData{
+			RDAPIKey:       "rd-token",
+			ProwlarrURL:    "http://indexer:9696",
+			ProwlarrAPIKey: "<key>",
+			Indexers:       []IndexerPreference{{ID: 3, Priority: PriorityHigh}},
+		})
+		require.NoError(t, err)
+
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/"+token+"/configure", nil))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		require.Contains(t, string(body), `value="rd-token"`)
+		require.Contains(t, string(body), `value="http://indexer:9696"`)
+		require.Contains(t, string(body), `value="&lt;key&gt;"`)
+		require.Contains(t, string(body), `[{"id":3,"p":1}]`)
+		require.Equal(t, "no-store", resp.Header.Get(fiber.HeaderCacheControl))
+	})
+}
+
+func TestHandleValidate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/rest/1.0/user" && r.Header.Get("Authorization") == "Bearer good":
+			_, _ = w.Write([]byte(`{"id":1,"username":"user","type":"premium"}`))
+		case r.URL.Path == "/api/v1/indexer" && r.Header.Get("X-Api-Key") == "good":
+			_, _ = w.Write([]byte(`[{"id":1,"name":"enabled","enable":true},{"id":2,"name":"disabled","enable":false}]`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"bad_token","error_code":8}`))
+		}
+	}))
+	defer server.Close()
+
+	target, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	add := New(WithTransport(rewriteTransport{target: target}))
+	app := fiber.New()
+	app.Post("/validate", add.HandleValidate)
+
+	validate := func(t *testing.T, body string) ValidateResponse {
+		req := httptest.NewRequest(fiber.MethodPost, "/validate", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		result := ValidateResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	t.Run("should list enabled indexers for valid credentials", func(t *testing.T) {
+		result := validate(t, `{"rd":"good","pUrl":"`+server.URL+`","pKey":"good"}`)
+		require.True(t, result.RealDebrid.OK)
+		require.Equal(t, "user", result.RealDebrid.Username)
+		require.True(t, result.RealDebrid.Premium)
+		require.True(t, result.Prowlarr.OK)
+		require.Equal(t, []IndexerStatus{{ID: 1, Name: "enabled"}}, result.Prowlarr.Indexers)
+	})
+
+	t.Run("should report invalid credentials", func(t *testing.T) {
+		result := validate(t, `{"rd":"bad","pUrl":"`+server.URL+`","pKey":"bad"}`)
+		require.False(t, result.RealDebrid.OK)
+		require.NotEmpty(t, result.RealDebrid.Error)
+		require.False(t, result.Prowlarr.OK)
+		require.NotEmpty(t, result.Prowlarr.Error)
+	})
+}
@@ -0,0 +1,202 @@
+package addon
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bongnv/prowlarr-stremio/internal/debrid/realdebrid"
+	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/titleparser"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The outcomes of a candidate torrent.
+const (
+	StatusExcluded    = "excluded"
+	StatusNoInfoHash  = "no-infohash"
+	StatusNotCached   = "not-cached"
+	StatusNoMediaFile = "no-media-file"
+	StatusTooBig      = "too-big"
+	StatusOutranked   = "outranked"
+	StatusSelected    = "selected"
+	// StatusNotReached means the pipeline stopped before the torrent was processed, e.g. as enough streams were found.
+	StatusNotReached = "not-reached"
+)
+
+type ExplainResponse struct {
+	Meta       *model.MetaInfo     `json:"meta"`
+	Candidates []*ExplainCandidate `json:"candidates"`
+}
+
+// ExplainCandidate is what happened to a torrent found by one or more indexers.
+type ExplainCandidate struct {
+	Title     string                `json:"title"`
+	Indexer   string                `json:"indexer"`
+	InfoHash  string                `json:"infoHash,omitempty"`
+	Seeders   uint                  `json:"seeders"`
+	TitleInfo *titleparser.MetaInfo `json:"titleInfo,omitempty"`
+	Filters   *FilterDecision       `json:"filters,omitempty"`
+	// Cached reports whether the debrid service has the torrent, nil if it wasn't checked.
+	Cached    *bool            `json:"cached,omitempty"`
+	MediaFile *realdebrid.File `json:"mediaFile,omitempty"`
+	Score     *ExplainScore    `json:"score,omitempty"`
+	// Rank is the position in the streams, starting from 1, 0 if the torrent wasn't selected.
+	Rank   int    `json:"rank,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// FilterDecision is the outcome of each check made on the title of a torrent.
+type FilterDecision struct {
+	Quality bool `json:"quality"`
+	IMDb    bool `json:"imdb"`
+	TVDB    bool `json:"tvdb"`
+	Year    bool `json:"year"`
+	Season  bool `json:"season"`
+	Episode bool `json:"episode"`
+	// TitleDistance is the distance to the closest title, -1 if the title wasn't checked as an ID matched.
+	TitleDistance int  `json:"titleDistance"`
+	Kept          bool `json:"kept"`
+}
+
+// ExplainScore is what streams are ranked by, in order.
+type ExplainScore struct {
+	Resolution int             `json:"resolution"`
+	Priority   IndexerPriority `json:"priority"`
+	FileSize   uint64          `json:"fileSize"`
+}
+
+// explainer records what happens to every torrent of an explained request.
+// Records of other requests have no explainer.
+type explainer struct {
+	mu         sync.Mutex
+	meta       *model.MetaInfo
+	candidates map[string]*ExplainCandidate
+	order      []*ExplainCandidate
+}
+
+func newExplainer() *explainer {
+	return &explainer{
+		candidates: map[string]*ExplainCandidate{},
+	}
+}
+
+// HandleExplain runs the same pipelines as HandleGetStreams and reports why each torrent was kept or dropped.
+func (add *Addon) HandleExplain(c *fiber.Ctx) error {
+	explain := newExplainer()
+	records, _, err := add.findStreams(c, explain)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(explain.response(records))
+}
+
+func (e *explainer) setMeta(meta *model.MetaInfo) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.meta = meta
+}
+
+// explain updates the candidate of the torrent of r if the request is explained.
+func (r *streamRecord) explain(update func(candidate *ExplainCandidate)) {
+	e := r.Explainer
+	if e == nil || r.Torrent == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	candidate := e.candidate(r.Torrent)
+	if candidate == nil {
+		candidate = &ExplainCandidate{
+			Title:   r.Torrent.Title,
+			Indexer: r.indexerNames(),
+			Seeders: r.Torrent.Seeders,
+		}
+		e.order = append(e.order, candidate)
+	}
+
+	for _, key := range candidateKeys(r.Torrent) {
+		e.candidates[key] = candidate
+	}
+
+	candidate.InfoHash = r.Torrent.InfoHash
+	candidate.TitleInfo = r.TitleInfo
+	update(candidate)
+}
+
+// candidate returns the candidate of torrent, nil if it hasn't been seen yet.
+func (e *explainer) candidate(torrent *prowlarr.Torrent) *ExplainCandidate {
+	for _, key := range candidateKeys(torrent) {
+		if candidate, ok := e.candidates[key]; ok {
+			return candidate
+		}
+	}
+
+	return nil
+}
+
+// candidateKeys identify a torrent by its info hash and its GUID, as searches return copies of the same torrent.
+// Both are kept so a torrent seen before its info hash was fetched is still found by GUID afterwards.
+func candidateKeys(torrent *prowlarr.Torrent) []string {
+	keys := []string{}
+	if torrent.InfoHash != "" {
+		keys = append(keys, "hash|"+torrent.InfoHash)
+	}
+
+	if torrent.Guid != "" {
+		keys = append(keys, "guid|"+torrent.Guid)
+	}
+
+	if len(keys) == 0 {
+		keys = append(keys, fmt.Sprintf("torrent|%p", torrent))
+	}
+
+	return keys
+}
+
+// explainStatus sets the outcome of the torrent of r.
+func (r *streamRecord) explainStatus(status, reason string) {
+	r.explain(func(candidate *ExplainCandidate) {
+		candidate.Status = status
+		candidate.Reason = reason
+	})
+}
+
+// response marks the selected streams and lists the candidates in the order they were found.
+func (e *explainer) response(selected []*streamRecord) ExplainResponse {
+	for i, r := range selected {
+		r.explain(func(candidate *ExplainCandidate) {
+			candidate.Rank = i + 1
+			candidate.Status = StatusSelected
+		})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	candidates := make([]*ExplainCandidate, 0, len(e.order))
+	for _, candidate := range e.order {
+		switch {
+		case candidate.Status != "":
+		case candidate.Score != nil:
+			candidate.Status = StatusOutranked
+		default:
+			candidate.Status = StatusNotReached
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return ExplainResponse{
+		Meta:       e.meta,
+		Candidates: candidates,
+	}
+}
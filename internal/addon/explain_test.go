@@ -0,0 +1,102 @@
+package addon
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bongnv/prowlarr-stremio/internal/debrid/realdebrid"
+	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	meta := &model.MetaInfo{Name: "Big Buck Bunny", FromYear: 2008, ToYear: 2008}
+	stages := fakeStages(meta, map[int][]*prowlarr.Torrent{
+		1: {
+			{Title: "Big Buck Bunny 2008 1080p", InfoHash: "a", Seeders: 5},
+			{Title: "Big Buck Bunny 2008 720p", InfoHash: "b", Seeders: 3},
+			{Title: "Another Movie 2008 1080p", InfoHash: "c", Seeders: 50},
+		},
+	}, "Big Buck Bunny.mkv")
+	stages.enrichCachedFiles = func(_ context.Context, records []*streamRecord) ([]*streamRecord, error) {
+		cached := []*streamRecord{}
+		for _, r := range records {
+			cachedByRD := r.Torrent.InfoHash == "a"
+			r.explain(func(candidate *ExplainCandidate) { candidate.Cached = &cachedByRD })
+			if cachedByRD {
+				r.Files = []*realdebrid.File{{ID: "1", FileName: "Big Buck Bunny.mkv", FileSize: 1 << 30}}
+				cached = append(cached, r)
+			} else {
+				r.explainStatus(StatusNotCached, "")
+			}
+		}
+		return cached, nil
+	}
+
+	explain := newExplainer()
+	p := pipe.New(context.Background(), func(_ context.Context) ([]*streamRecord, error) {
+		return []*streamRecord{{ContentType: ContentTypeMovie, ID: "tt1", Explainer: explain}}, nil
+	})
+	buildMoviePipeline(p, stages, PipelineConfig{}.withDefaults())
+	top := pipe.NewTopK(defaultMaxStreams, cmpLowerQuality)
+	(&Addon{}).sinkResults(context.Background(), p, top.Sink)
+
+	resp := explain.response(top.Results())
+	require.Len(t, resp.Candidates, 3)
+
+	byHash := map[string]*ExplainCandidate{}
+	for _, candidate := range resp.Candidates {
+		byHash[candidate.InfoHash] = candidate
+	}
+
+	selected := byHash["a"]
+	require.Equal(t, StatusSelected, selected.Status)
+	require.Equal(t, 1, selected.Rank)
+	require.True(t, *selected.Cached)
+	require.Equal(t, "Big Buck Bunny.mkv", selected.MediaFile.FileName)
+	require.Equal(t, 1080, selected.Score.Resolution)
+	require.True(t, selected.Filters.Kept)
+
+	require.Equal(t, StatusNotCached, byHash["b"].Status)
+	require.False(t, *byHash["b"].Cached)
+
+	excluded := byHash["c"]
+	require.Equal(t, StatusExcluded, excluded.Status)
+	require.False(t, excluded.Filters.Kept)
+	require.GreaterOrEqual(t, excluded.Filters.TitleDistance, maxTitleDistance)
+	require.Nil(t, excluded.Cached)
+}
+
+func TestExplain_SameTorrentFromTwoSearches(t *testing.T) {
+	meta := &model.MetaInfo{Name: "Big Buck Bunny", FromYear: 2008, ToYear: 2008}
+	// searches return copies of the same torrent, the first one without its info hash
+	stages := fakeStages(meta, map[int][]*prowlarr.Torrent{
+		1: {{Title: "Big Buck Bunny 2008 1080p", Guid: "guid-a", Seeders: 5}},
+		2: {{Title: "Big Buck Bunny 2008 1080p", Guid: "guid-a", InfoHash: "a", Seeders: 7}},
+	}, "Big Buck Bunny.mkv")
+	stages.enrichInfoHash = func(_ context.Context, r *streamRecord) ([]*streamRecord, error) {
+		r.Torrent.InfoHash = "a"
+		return []*streamRecord{r}, nil
+	}
+
+	explain := newExplainer()
+	p := pipe.New(context.Background(), func(_ context.Context) ([]*streamRecord, error) {
+		return []*streamRecord{{ContentType: ContentTypeMovie, ID: "tt1", Explainer: explain}}, nil
+	})
+	buildMoviePipeline(p, stages, PipelineConfig{}.withDefaults())
+	top := pipe.NewTopK(defaultMaxStreams, cmpLowerQuality)
+	(&Addon{}).sinkResults(context.Background(), p, top.Sink)
+
+	resp := explain.response(top.Results())
+	require.Len(t, resp.Candidates, 1)
+
+	candidate := resp.Candidates[0]
+	require.Equal(t, StatusSelected, candidate.Status)
+	require.Equal(t, 1, candidate.Rank)
+	require.Equal(t, "a", candidate.InfoHash)
+	require.Equal(t, uint(7), candidate.Seeders)
+	require.ElementsMatch(t, []string{"indexer-1", "indexer-2"}, strings.Split(candidate.Indexer, ", "))
+}
@@ -1,7 +1,15 @@
 package addon
 
 import (
+	"context"
+	"net/http"
+
+	"github.com/bongnv/prowlarr-stremio/internal/health"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/profile"
+	"github.com/bongnv/prowlarr-stremio/internal/prom"
 	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/bongnv/prowlarr-stremio/internal/proxy"
 )
 
 func WithID(id string) Option {
@@ -18,7 +26,8 @@ func WithName(name string) Option {
 
 func WithProwlarr(jacketUrl string, jacketApiKey string) Option {
 	return func(a *Addon) {
-		a.prowlarrClient = prowlarr.New(jacketUrl, jacketApiKey)
+		a.prowlarrURL = jacketUrl
+		a.prowlarrAPIKey = jacketApiKey
 	}
 }
 
@@ -33,3 +42,98 @@ func WithVersion(version string) Option {
 		a.version = version
 	}
 }
+
+// WithStreamProxy makes the addon stream files through the server instead of redirecting to RD.
+func WithStreamProxy(streamProxy *proxy.Proxy) Option {
+	return func(a *Addon) {
+		a.streamProxy = streamProxy
+	}
+}
+
+// WithUserDataSecret encrypts and authenticates userData tokens with secret.
+// Legacy plain JSON userData is only accepted when allowPlain is set.
+func WithUserDataSecret(secret string, allowPlain bool) Option {
+	return func(a *Addon) {
+		a.userDataSecret = secret
+		a.allowPlainUserData = allowPlain
+	}
+}
+
+// WithTransport sets the transport shared by all outbound clients, e.g. one guarded by netguard.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(a *Addon) {
+		a.transport = transport
+	}
+}
+
+// WithProfileStore lets users install the addon with a short profile ID instead of the whole configuration.
+func WithProfileStore(store *profile.Store) Option {
+	return func(a *Addon) {
+		a.profileStore = store
+	}
+}
+
+// WithMaxConcurrentPipelines caps the number of stream requests processed at the same time.
+func WithMaxConcurrentPipelines(maxPipelines int) Option {
+	return func(a *Addon) {
+		if maxPipelines > 0 {
+			a.pipelineSlots = make(chan struct{}, maxPipelines)
+		}
+	}
+}
+
+// WithPipeObserver observes the stream pipelines. newObserver is called once per request.
+func WithPipeObserver(newObserver func(ctx context.Context) pipe.Observer) Option {
+	return func(a *Addon) {
+		a.newObserver = newObserver
+	}
+}
+
+// WithPipelineConfig tunes the concurrency, timeout and number of results of the stream pipelines.
+func WithPipelineConfig(cfg PipelineConfig) Option {
+	return func(a *Addon) {
+		a.pipelineConfig = cfg
+	}
+}
+
+// WithIndexerHealth shares the indexer health stats, e.g. with an admin endpoint.
+func WithIndexerHealth(tracker *health.Tracker) Option {
+	return func(a *Addon) {
+		a.indexerHealth = tracker
+	}
+}
+
+// WithProwlarrCache sets the cache of indexers and search results shared by all Prowlarr clients.
+func WithProwlarrCache(cache *prowlarr.Cache) Option {
+	return func(a *Addon) {
+		a.prowlarrCache = cache
+	}
+}
+
+// WithMetaProvider replaces Cinemeta as the source of metadata, e.g. with TMDB.
+func WithMetaProvider(provider MetaProvider) Option {
+	return func(a *Addon) {
+		a.metaProvider = provider
+	}
+}
+
+// WithMetrics exports the metrics of stream requests, indexer searches, RD requests and caches.
+func WithMetrics(metrics *prom.Metrics) Option {
+	return func(a *Addon) {
+		a.metrics = metrics
+	}
+}
+
+// WithCacheSize sets the size in bytes of the cache of info hashes and download links, 50MB by default.
+func WithCacheSize(size int) Option {
+	return func(a *Addon) {
+		a.cacheSize = size
+	}
+}
+
+// WithRealDebridURL makes RD clients send requests to baseURL instead of the RD API, e.g. a stand-in server.
+func WithRealDebridURL(baseURL string) Option {
+	return func(a *Addon) {
+		a.realDebridURL = baseURL
+	}
+}
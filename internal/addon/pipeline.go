@@ -0,0 +1,165 @@
+package addon
+
+import (
+	"context"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+)
+
+const (
+	defaultSearchConcurrency    = 10
+	defaultInfoHashConcurrency  = 10
+	defaultDebridWorkers        = 2
+	defaultMediaFileConcurrency = 5
+	defaultStreamsTimeout       = 20 * time.Second
+	defaultMaxStreams           = 5
+)
+
+// PipelineConfig tunes the stages of the stream pipelines. Zero values fall back to the defaults.
+type PipelineConfig struct {
+	// SearchConcurrency is the number of indexers searched at the same time.
+	SearchConcurrency int
+	// InfoHashConcurrency is the number of torrents resolved to an info hash at the same time.
+	InfoHashConcurrency int
+	// DebridWorkers is the number of batches checked against the debrid service at the same time.
+	DebridWorkers int
+	// MediaFileConcurrency is the number of torrents searched for the media file at the same time.
+	MediaFileConcurrency int
+	// Timeout bounds the time spent finding the streams of a request.
+	Timeout time.Duration
+	// MaxStreams is the number of streams returned.
+	MaxStreams int
+}
+
+func (cfg PipelineConfig) withDefaults() PipelineConfig {
+	if cfg.SearchConcurrency <= 0 {
+		cfg.SearchConcurrency = defaultSearchConcurrency
+	}
+
+	if cfg.InfoHashConcurrency <= 0 {
+		cfg.InfoHashConcurrency = defaultInfoHashConcurrency
+	}
+
+	if cfg.DebridWorkers <= 0 {
+		cfg.DebridWorkers = defaultDebridWorkers
+	}
+
+	if cfg.MediaFileConcurrency <= 0 {
+		cfg.MediaFileConcurrency = defaultMediaFileConcurrency
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultStreamsTimeout
+	}
+
+	if cfg.MaxStreams <= 0 {
+		cfg.MaxStreams = defaultMaxStreams
+	}
+
+	return cfg
+}
+
+// streamStages are the functions which talk to external services in a stream pipeline.
+// They are replaced by fakes to test the pipelines.
+type streamStages struct {
+	fetchMovieMeta       func(ctx context.Context, r *streamRecord) (*streamRecord, error)
+	fetchSeriesMeta      func(ctx context.Context, r *streamRecord) (*streamRecord, error)
+	listIndexers         func(ctx context.Context, r *streamRecord) ([]*streamRecord, error)
+	searchMovieTorrents  func(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error
+	searchSeriesTorrents func(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error
+	enrichInfoHash       func(ctx context.Context, r *streamRecord) ([]*streamRecord, error)
+	enrichCachedFiles    func(ctx context.Context, records []*streamRecord) ([]*streamRecord, error)
+}
+
+func (add *Addon) streamStages() streamStages {
+	return streamStages{
+		fetchMovieMeta:       add.fetchMovieMeta,
+		fetchSeriesMeta:      add.fetchSeriesMeta,
+		listIndexers:         add.fanOutToAllIndexers,
+		searchMovieTorrents:  add.searchMovieTorrents,
+		searchSeriesTorrents: add.searchSeriesTorrents,
+		enrichInfoHash:       add.enrichInfoHash,
+		enrichCachedFiles:    add.enrichWithCachedFiles,
+	}
+}
+
+// streamPipeline adds the stages finding streams of one content type to p.
+type streamPipeline func(p *pipe.Pipe[streamRecord], stages streamStages, cfg PipelineConfig)
+
+// streamPipelines are the pipelines by content type. A content type without a pipeline isn't supported.
+var streamPipelines = map[ContentType]streamPipeline{
+	ContentTypeMovie:  buildMoviePipeline,
+	ContentTypeSeries: buildSeriesPipeline,
+}
+
+func buildMoviePipeline(p *pipe.Pipe[streamRecord], stages streamStages, cfg PipelineConfig) {
+	p.Map(stages.fetchMovieMeta, pipe.Name[streamRecord]("metainfo"))
+	addSearchStages(p, stages.listIndexers, stages.searchMovieTorrents, cfg)
+	addTorrentStages(p, stages, cfg)
+	addMediaFileStages(p, locateMovieFile, cfg)
+}
+
+func buildSeriesPipeline(p *pipe.Pipe[streamRecord], stages streamStages, cfg PipelineConfig) {
+	p.Map(stages.fetchSeriesMeta, pipe.Name[streamRecord]("metainfo"))
+	addSearchStages(p, stages.listIndexers, stages.searchSeriesTorrents, cfg)
+	addTorrentStages(p, stages, cfg)
+	addMediaFileStages(p, locateEpisodeFile, cfg)
+}
+
+// addSearchStages searches every indexer and parses the titles of the torrents found.
+func addSearchStages(
+	p *pipe.Pipe[streamRecord],
+	listIndexers func(ctx context.Context, r *streamRecord) ([]*streamRecord, error),
+	search func(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error,
+	cfg PipelineConfig,
+) {
+	p.FanOut(listIndexers, pipe.Name[streamRecord]("indexers"))
+	p.Channel(search,
+		pipe.Name[streamRecord]("search"),
+		pipe.Concurrency[streamRecord](cfg.SearchConcurrency),
+		pipe.SkipOnError[streamRecord](),
+	)
+	p.Map(parseTorrentTitle, pipe.Name[streamRecord]("parse-title"))
+	p.Filter(excludeTorrents, pipe.Name[streamRecord]("exclude"))
+}
+
+// addTorrentStages resolves the torrents, merges duplicates and keeps those cached by the debrid service.
+func addTorrentStages(p *pipe.Pipe[streamRecord], stages streamStages, cfg PipelineConfig) {
+	p.Shuffle(hasMoreSeeders, pipe.Name[streamRecord]("shuffle"))
+	p.FanOut(stages.enrichInfoHash,
+		pipe.Name[streamRecord]("infohash"),
+		pipe.Concurrency[streamRecord](cfg.InfoHashConcurrency),
+		pipe.Retry[streamRecord](1, infoHashRetryBackoff),
+		pipe.SkipOnError[streamRecord](),
+	)
+	p.Merge(torrentKey, mergeTorrents,
+		pipe.Name[streamRecord]("dedupe"),
+		pipe.MergeWindow[streamRecord](dedupeWindow),
+	)
+	p.Batch(stages.enrichCachedFiles,
+		pipe.Name[streamRecord]("rd-cached"),
+		pipe.WorkerSize[streamRecord](cfg.DebridWorkers),
+		pipe.MinSize[streamRecord](debridBatchMinSize),
+		pipe.MaxWait[streamRecord](debridBatchMaxWait),
+		pipe.Retry[streamRecord](2, debridRetryBackoff),
+		pipe.SkipOnError[streamRecord](),
+	)
+}
+
+// addMediaFileStages locates the media file in each torrent and stops once there are enough good streams.
+func addMediaFileStages(
+	p *pipe.Pipe[streamRecord],
+	locate func(ctx context.Context, r *streamRecord) ([]*streamRecord, error),
+	cfg PipelineConfig,
+) {
+	p.FanOut(locate,
+		pipe.Name[streamRecord]("media-file"),
+		pipe.Concurrency[streamRecord](cfg.MediaFileConcurrency),
+	)
+	p.Take(cfg.MaxStreams,
+		pipe.Name[streamRecord]("take"),
+		pipe.TakeIf(isGoodQuality),
+		pipe.SoftDeadline[streamRecord](streamsSoftDeadline),
+	)
+}
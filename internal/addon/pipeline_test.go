@@ -0,0 +1,161 @@
+package addon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/debrid/realdebrid"
+	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipetest"
+	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStages serves torrents by indexer ID and lists fileName in every torrent.
+func fakeStages(meta *model.MetaInfo, torrents map[int][]*prowlarr.Torrent, fileName string) streamStages {
+	fetchMeta := func(_ context.Context, r *streamRecord) (*streamRecord, error) {
+		r.MetaInfo = meta
+		return r, nil
+	}
+
+	search := func(ctx context.Context, r *streamRecord, outCh chan<- *streamRecord) error {
+		sendTorrents(ctx, r, torrents[r.Indexer.ID], outCh)
+		return nil
+	}
+
+	return streamStages{
+		fetchMovieMeta:  fetchMeta,
+		fetchSeriesMeta: fetchMeta,
+		listIndexers: func(_ context.Context, r *streamRecord) ([]*streamRecord, error) {
+			records := make([]*streamRecord, 0, len(torrents))
+			for id := range torrents {
+				newR := *r
+				newR.Indexer = &prowlarr.Indexer{ID: id, Name: fmt.Sprintf("indexer-%d", id)}
+				records = append(records, &newR)
+			}
+			return records, nil
+		},
+		searchMovieTorrents:  search,
+		searchSeriesTorrents: search,
+		enrichInfoHash: func(_ context.Context, r *streamRecord) ([]*streamRecord, error) {
+			return []*streamRecord{r}, nil
+		},
+		enrichCachedFiles: func(_ context.Context, records []*streamRecord) ([]*streamRecord, error) {
+			for _, r := range records {
+				r.Files = []*realdebrid.File{{ID: "1", FileName: fileName, FileSize: 1 << 30}}
+			}
+			return records, nil
+		},
+	}
+}
+
+func runPipeline(t *testing.T, contentType ContentType, r *streamRecord, stages streamStages) []*streamRecord {
+	t.Helper()
+
+	buildPipeline, ok := streamPipelines[contentType]
+	require.True(t, ok)
+
+	p := pipe.New(context.Background(), func(_ context.Context) ([]*streamRecord, error) {
+		return []*streamRecord{r}, nil
+	})
+	buildPipeline(p, stages, PipelineConfig{}.withDefaults())
+
+	var records []*streamRecord
+	require.NoError(t, p.Sink(func(r *streamRecord) error {
+		records = append(records, r)
+		return nil
+	}))
+	return records
+}
+
+func TestMoviePipeline(t *testing.T) {
+	meta := &model.MetaInfo{Name: "Big Buck Bunny", FromYear: 2008, ToYear: 2008}
+	stages := fakeStages(meta, map[int][]*prowlarr.Torrent{
+		1: {
+			{Title: "Big Buck Bunny 2008 1080p", InfoHash: "a", Seeders: 5},
+			{Title: "Big Buck Bunny 2008 720p", InfoHash: "b", Seeders: 3},
+		},
+		2: {
+			{Title: "Big.Buck.Bunny.2008.1080p.WEB", InfoHash: "a", Seeders: 10},
+			{Title: "Another Movie 2008 1080p", InfoHash: "c", Seeders: 50},
+		},
+	}, "Big Buck Bunny.mkv")
+
+	records := runPipeline(t, ContentTypeMovie, &streamRecord{ContentType: ContentTypeMovie, ID: "tt1"}, stages)
+	require.Len(t, records, 2)
+
+	byHash := map[string]*streamRecord{}
+	for _, r := range records {
+		byHash[r.Torrent.InfoHash] = r
+		require.Equal(t, "Big Buck Bunny.mkv", r.MediaFile.FileName)
+	}
+
+	require.Equal(t, uint(10), byHash["a"].Torrent.Seeders)
+	require.Len(t, byHash["a"].allIndexers(), 2)
+	require.Equal(t, 720, byHash["b"].TitleInfo.Resolution)
+}
+
+func TestSeriesPipeline(t *testing.T) {
+	meta := &model.MetaInfo{Name: "Big Buck Bunny", FromYear: 2008, ToYear: 2010}
+	stages := fakeStages(meta, map[int][]*prowlarr.Torrent{
+		1: {
+			{Title: "Big Buck Bunny S01E02 1080p", InfoHash: "a", Seeders: 5},
+			{Title: "Big Buck Bunny S01E03 1080p", InfoHash: "b", Seeders: 5},
+		},
+	}, "Big.Buck.Bunny.S01E02.mkv")
+
+	records := runPipeline(t, ContentTypeSeries, &streamRecord{ContentType: ContentTypeSeries, ID: "tt1", Season: 1, Episode: 2}, stages)
+	require.Len(t, records, 1)
+	require.Equal(t, "a", records[0].Torrent.InfoHash)
+	require.Equal(t, "Big.Buck.Bunny.S01E02.mkv", records[0].MediaFile.FileName)
+}
+
+func TestUniqueTorrentsAcrossTiers(t *testing.T) {
+	meta := &model.MetaInfo{Name: "Big Buck Bunny", FromYear: 2008, ToYear: 2008}
+	tiers := []map[int][]*prowlarr.Torrent{
+		{1: {{Title: "Big Buck Bunny 2008 1080p", InfoHash: "a", Seeders: 5}}},
+		{2: {
+			{Title: "Big.Buck.Bunny.2008.1080p.WEB", InfoHash: "a", Seeders: 10},
+			{Title: "Big Buck Bunny 2008 720p", InfoHash: "b", Seeders: 3},
+		}},
+	}
+
+	top := pipe.NewTopK(defaultMaxStreams, cmpLowerQuality)
+	sink := uniqueTorrents(top.Sink)
+	for _, torrents := range tiers {
+		p := pipe.New(context.Background(), func(_ context.Context) ([]*streamRecord, error) {
+			return []*streamRecord{{ContentType: ContentTypeMovie, ID: "tt1"}}, nil
+		})
+		buildMoviePipeline(p, fakeStages(meta, torrents, "Big Buck Bunny.mkv"), PipelineConfig{}.withDefaults())
+		(&Addon{}).sinkResults(context.Background(), p, sink)
+	}
+
+	results := top.Results()
+	require.Len(t, results, 2)
+	require.Equal(t, "a", results[0].Torrent.InfoHash)
+	require.Equal(t, uint(5), results[0].Torrent.Seeders, "the first tier should win")
+	require.Equal(t, "b", results[1].Torrent.InfoHash)
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	add := New(WithPipelineConfig(PipelineConfig{Timeout: 30 * time.Second}))
+	h := pipetest.New[streamRecord](t, add.pipeOptions(context.Background())...)
+	h.Pipe.Map(func(_ context.Context, r *streamRecord) (*streamRecord, error) {
+		return r, nil
+	}, pipe.Name[streamRecord]("map"))
+	h.Start()
+
+	h.Clock.BlockUntil(1)
+	h.Clock.Advance(29 * time.Second)
+	// the timer of the timeout is still pending, the default would have fired
+	h.Clock.BlockUntil(1)
+	h.Send(&streamRecord{ID: "tt1"})
+	require.Equal(t, "tt1", h.Next().ID)
+
+	h.Clock.Advance(time.Second)
+	h.WaitFinished("map")
+	require.NoError(t, h.Wait())
+}
@@ -1,7 +1,182 @@
 package addon
 
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+)
+
+const (
+	userDataTokenVersion = 1
+	userDataTokenAAD     = "prowlarr-stremio/userData"
+)
+
+var (
+	errInvalidUserDataToken = errors.New("invalid userData token")
+)
+
 type UserData struct {
 	RDAPIKey       string `json:"rd"`
 	ProwlarrURL    string `json:"pUrl"`
 	ProwlarrAPIKey string `json:"pKey"`
+	// Indexers are the indexers chosen by the user. All enabled indexers are used if it's empty.
+	Indexers []IndexerPreference `json:"idx,omitempty"`
+}
+
+// IndexerPriority ranks the indexers chosen by a user. Indexers with a lower value are searched first
+// and their torrents are ranked higher.
+type IndexerPriority int
+
+const (
+	PriorityHigh   IndexerPriority = 1
+	PriorityNormal IndexerPriority = 2
+	PriorityLow    IndexerPriority = 3
+)
+
+// IndexerPreference is how a user wants an indexer to be used.
+type IndexerPreference struct {
+	ID       int             `json:"id"`
+	Priority IndexerPriority `json:"p"`
+}
+
+func (p IndexerPriority) normalize() IndexerPriority {
+	if p < PriorityHigh || p > PriorityLow {
+		return PriorityNormal
+	}
+
+	return p
+}
+
+// indexerPriorities maps the IDs of the chosen indexers to their priority.
+// It's nil when the user hasn't chosen any, meaning all indexers are used.
+func (u *UserData) indexerPriorities() map[int]IndexerPriority {
+	if len(u.Indexers) == 0 {
+		return nil
+	}
+
+	priorities := make(map[int]IndexerPriority, len(u.Indexers))
+	for _, pref := range u.Indexers {
+		priorities[pref.ID] = pref.Priority.normalize()
+	}
+
+	return priorities
+}
+
+// tiers returns the priorities to search in order. A zero tier searches all indexers at once.
+func (u *UserData) tiers() []IndexerPriority {
+	tiers := []IndexerPriority{}
+	for _, priority := range u.indexerPriorities() {
+		if !slices.Contains(tiers, priority) {
+			tiers = append(tiers, priority)
+		}
+	}
+
+	if len(tiers) == 0 {
+		return []IndexerPriority{0}
+	}
+
+	slices.Sort(tiers)
+	return tiers
+}
+
+// userDataCodec converts UserData to and from the opaque token used in addon URLs.
+// Without a secret, tokens are URL-escaped JSON like the legacy format.
+type userDataCodec struct {
+	aead       cipher.AEAD
+	allowPlain bool
+}
+
+func newUserDataCodec(secret string, allowPlain bool) (*userDataCodec, error) {
+	if secret == "" {
+		return &userDataCodec{allowPlain: true}, nil
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userDataCodec{
+		aead:       aead,
+		allowPlain: allowPlain,
+	}, nil
+}
+
+func (codec *userDataCodec) encode(userData *UserData) (string, error) {
+	plaintext, err := json.Marshal(userData)
+	if err != nil {
+		return "", err
+	}
+
+	if codec.aead == nil {
+		return url.PathEscape(string(plaintext)), nil
+	}
+
+	nonceSize := codec.aead.NonceSize()
+	token := make([]byte, 1+nonceSize, 1+nonceSize+len(plaintext)+codec.aead.Overhead())
+	token[0] = userDataTokenVersion
+	if _, err := rand.Read(token[1:]); err != nil {
+		return "", err
+	}
+
+	token = codec.aead.Seal(token, token[1:], plaintext, []byte(userDataTokenAAD))
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func (codec *userDataCodec) decode(raw string) (*UserData, error) {
+	if codec.aead != nil {
+		userData, err := codec.decrypt(raw)
+		if err == nil || !codec.allowPlain {
+			return userData, err
+		}
+	}
+
+	userDataJson, err := url.PathUnescape(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	userData := &UserData{}
+	if err := json.Unmarshal([]byte(userDataJson), userData); err != nil {
+		return nil, err
+	}
+
+	return userData, nil
+}
+
+func (codec *userDataCodec) decrypt(raw string) (*UserData, error) {
+	token, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errInvalidUserDataToken
+	}
+
+	nonceSize := codec.aead.NonceSize()
+	if len(token) < 1+nonceSize+codec.aead.Overhead() || token[0] != userDataTokenVersion {
+		return nil, errInvalidUserDataToken
+	}
+
+	nonce := token[1 : 1+nonceSize]
+	plaintext, err := codec.aead.Open(nil, nonce, token[1+nonceSize:], []byte(userDataTokenAAD))
+	if err != nil {
+		return nil, errInvalidUserDataToken
+	}
+
+	userData := &UserData{}
+	if err := json.Unmarshal(plaintext, userData); err != nil {
+		return nil, errInvalidUserDataToken
+	}
+
+	return userData, nil
 }
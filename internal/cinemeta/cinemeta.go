@@ -1,15 +1,37 @@
 package cinemeta
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/coocood/freecache"
 	"github.com/go-resty/resty/v2"
 )
 
+const (
+	requestTimeout = 5 * time.Second
+	retryCount     = 2
+	retryWaitTime  = 200 * time.Millisecond
+	cacheSize      = 10 * 1024 * 1024 // 10MB
+	defaultTTL     = 24 * time.Hour
+)
+
+// ErrNotFound is returned when Cinemeta doesn't know the requested ID.
+var ErrNotFound = errors.New("meta not found")
+
 type CineMeta struct {
 	client *resty.Client
+	cache  *freecache.Cache
+	ttl    time.Duration
+	now    func() time.Time
 }
 
 type MovieInfoResponse struct {
@@ -20,55 +42,163 @@ type MetaInfo struct {
 	Name   string `json:"name"`
 	Year   string `json:"year"`
 	IMDBID string `json:"imdb_id"`
+	// OriginalName and Aliases are only set for some titles, e.g. non-English ones.
+	OriginalName string   `json:"originalName"`
+	Aliases      []string `json:"aliases"`
+}
+
+type Option func(*CineMeta)
+
+// WithTransport makes the client use transport, e.g. to share connections or to guard outbound requests.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *CineMeta) {
+		c.client.SetTransport(transport)
+	}
 }
 
-func New() *CineMeta {
-	return &CineMeta{
-		client: resty.New().SetBaseURL("https://v3-cinemeta.strem.io"),
+// WithBaseURL makes the client send requests to baseURL instead of Cinemeta, e.g. a stand-in server.
+func WithBaseURL(baseURL string) Option {
+	return func(c *CineMeta) {
+		c.client.SetBaseURL(baseURL)
 	}
 }
 
-func (c *CineMeta) GetMovieById(id string) (*model.MetaInfo, error) {
-	resp, err := c.client.R().SetResult(&MovieInfoResponse{}).Get("/meta/movie/" + id + ".json")
+// WithCacheTTL sets how long metas are cached, metas are cached for a day by default.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *CineMeta) {
+		c.ttl = ttl
+	}
+}
+
+func New(opts ...Option) *CineMeta {
+	c := &CineMeta{
+		client: resty.New().
+			SetBaseURL("https://v3-cinemeta.strem.io").
+			SetTimeout(requestTimeout).
+			SetRetryCount(retryCount).
+			SetRetryWaitTime(retryWaitTime).
+			AddRetryCondition(func(resp *resty.Response, err error) bool {
+				return err != nil || resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= http.StatusInternalServerError
+			}),
+		cache: freecache.NewCache(cacheSize),
+		ttl:   defaultTTL,
+		now:   time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (c *CineMeta) GetMovieById(ctx context.Context, id string) (*model.MetaInfo, error) {
+	meta, releaseYear, err := c.getMeta(ctx, "movie", id)
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.Result().(*MovieInfoResponse)
-	year, _ := strconv.Atoi(result.Meta.Year)
-	imdbID, err := strconv.Atoi(strings.TrimPrefix(result.Meta.IMDBID, "tt"))
-
-	return &model.MetaInfo{
-		Name:     result.Meta.Name,
-		IMDBID:   uint(imdbID),
-		FromYear: year,
-		ToYear:   year,
-	}, nil
+	year, _ := strconv.Atoi(releaseYear)
+	meta.FromYear = year
+	meta.ToYear = year
+	return meta, nil
 }
 
-func (c CineMeta) GetSeriesById(id string) (*model.MetaInfo, error) {
-	resp, err := c.client.R().SetResult(&MovieInfoResponse{}).Get("/meta/series/" + id + ".json")
+// GetSeriesById returns the meta of a series, Cinemeta doesn't provide the air date of the episode.
+func (c *CineMeta) GetSeriesById(ctx context.Context, id string, _, _ int) (*model.MetaInfo, error) {
+	meta, years, err := c.getMeta(ctx, "series", id)
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.Result().(*MovieInfoResponse)
-	tokens := strings.Split(result.Meta.Year, "–")
-	fromYear := 0
-	toYear := 0
+	tokens := strings.Split(years, "–")
+	meta.FromYear, _ = strconv.Atoi(strings.TrimSpace(tokens[0]))
+	meta.ToYear = meta.FromYear
 	if len(tokens) > 1 {
-		fromYear, _ = strconv.Atoi(tokens[0])
-		toYear, _ = strconv.Atoi(tokens[1])
-	} else if len(tokens) > 0 {
-		fromYear, _ = strconv.Atoi(tokens[0])
-		toYear = fromYear
-	}
-	imdbID, err := strconv.Atoi(strings.TrimPrefix(result.Meta.IMDBID, "tt"))
-
-	return &model.MetaInfo{
-		Name:     result.Meta.Name,
-		IMDBID:   uint(imdbID),
-		FromYear: fromYear,
-		ToYear:   toYear,
-	}, nil
+		meta.ToYear, _ = strconv.Atoi(strings.TrimSpace(tokens[1]))
+		if meta.ToYear == 0 {
+			// the series is still running, e.g. "2011–"
+			meta.ToYear = c.now().Year()
+		}
+	}
+
+	return meta, nil
+}
+
+// cachedMeta is what's cached per ID, years are kept raw as they're parsed differently per type.
+type cachedMeta struct {
+	Meta  model.MetaInfo
+	Years string
+}
+
+// getMeta returns a copy of the meta of id, which is safe to modify, and its raw years.
+func (c *CineMeta) getMeta(ctx context.Context, contentType, id string) (*model.MetaInfo, string, error) {
+	key := []byte(contentType + "/" + id)
+	if data, err := c.cache.Get(key); err == nil {
+		cached := cachedMeta{}
+		if err := json.Unmarshal(data, &cached); err == nil {
+			return &cached.Meta, cached.Years, nil
+		}
+	}
+
+	resp, err := c.client.R().SetContext(ctx).SetResult(&MovieInfoResponse{}).Get("/meta/" + contentType + "/" + id + ".json")
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, "", fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	if resp.IsError() {
+		return nil, "", fmt.Errorf("error response from cinemeta: %s", resp.Status())
+	}
+
+	result := resp.Result().(*MovieInfoResponse)
+	if result.Meta.Name == "" {
+		return nil, "", fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	imdbID := result.Meta.IMDBID
+	if imdbID == "" {
+		imdbID = id
+	}
+	parsedID, err := strconv.Atoi(strings.TrimPrefix(imdbID, "tt"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid IMDb ID %q: %w", imdbID, err)
+	}
+
+	cached := cachedMeta{
+		Meta: model.MetaInfo{
+			Name:    result.Meta.Name,
+			IMDBID:  uint(parsedID),
+			Aliases: aliases(result.Meta),
+		},
+		Years: result.Meta.Year,
+	}
+
+	if data, err := json.Marshal(cached); err == nil {
+		if err := c.cache.Set(key, data, int(c.ttl.Seconds())); err != nil {
+			slog.WarnContext(ctx, "Failed to cache the meta", "id", id, "error", err)
+		}
+	}
+
+	return &cached.Meta, cached.Years, nil
+}
+
+// aliases returns the original name and the aliases of a meta which differ from its name.
+func aliases(meta MetaInfo) []string {
+	result := []string{}
+	seen := map[string]bool{strings.ToLower(meta.Name): true}
+	for _, alias := range append([]string{meta.OriginalName}, meta.Aliases...) {
+		alias = strings.TrimSpace(alias)
+		if alias == "" || seen[strings.ToLower(alias)] {
+			continue
+		}
+
+		seen[strings.ToLower(alias)] = true
+		result = append(result, alias)
+	}
+
+	return result
 }
@@ -0,0 +1,70 @@
+package cinemeta
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCineMeta(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/meta/movie/tt1.json":
+			_, _ = w.Write([]byte(`{"meta":{"name":"Big Buck Bunny","year":"2008","imdb_id":"tt1","originalName":"Gros Lapin","aliases":["big buck bunny","Gros Lapin",""]}}`))
+		case "/meta/series/tt2.json":
+			// the first request fails to check retries
+			if count == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{"meta":{"name":"Running Series","year":"2011–"}}`))
+		case "/meta/movie/tt3.json":
+			_, _ = w.Write([]byte(`{"meta":{}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := New(WithBaseURL(server.URL))
+	client.now = func() time.Time { return time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC) }
+
+	t.Run("should retry and parse running series", func(t *testing.T) {
+		meta, err := client.GetSeriesById(context.Background(), "tt2", 1, 1)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), requests.Load())
+		require.Equal(t, uint(2), meta.IMDBID)
+		require.Equal(t, 2011, meta.FromYear)
+		require.Equal(t, 2024, meta.ToYear)
+	})
+
+	t.Run("should extract aliases and cache metas", func(t *testing.T) {
+		meta, err := client.GetMovieById(context.Background(), "tt1")
+		require.NoError(t, err)
+		require.Equal(t, "Big Buck Bunny", meta.Name)
+		require.Equal(t, []string{"Gros Lapin"}, meta.Aliases)
+		require.Equal(t, 2008, meta.FromYear)
+
+		meta.Name = "modified"
+		cached, err := client.GetMovieById(context.Background(), "tt1")
+		require.NoError(t, err)
+		require.Equal(t, "Big Buck Bunny", cached.Name)
+		require.Equal(t, int32(3), requests.Load())
+	})
+
+	t.Run("should report unknown IDs", func(t *testing.T) {
+		_, err := client.GetMovieById(context.Background(), "tt3")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = client.GetMovieById(context.Background(), "tt4")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -1,13 +1,16 @@
 package realdebrid
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/go-resty/resty/v2"
-	"github.com/gofiber/fiber/v2/log"
 )
 
 var (
@@ -41,7 +44,47 @@ func (c *safeCatchedTorrentResponse) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func New(apiToken string, ipAddress string) *RealDebrid {
+type Option func(*RealDebrid)
+
+// RequestObserver is notified of every request to the RD API, e.g. to export metrics.
+// endpoint is the path without IDs, status is 0 if there was no response and errorCode is 0 if RD didn't return one.
+type RequestObserver func(endpoint string, status int, errorCode int)
+
+// WithTransport makes the client use transport, e.g. to share connections or to guard outbound requests.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(rd *RealDebrid) {
+		rd.client.SetTransport(transport)
+	}
+}
+
+// WithBaseURL makes the client send requests to baseURL instead of the RD API, e.g. a stand-in server.
+func WithBaseURL(baseURL string) Option {
+	return func(rd *RealDebrid) {
+		rd.client.SetBaseURL(baseURL)
+	}
+}
+
+// WithRequestObserver makes the client notify observe of every request.
+func WithRequestObserver(observe RequestObserver) Option {
+	return func(rd *RealDebrid) {
+		rd.client.OnSuccess(func(_ *resty.Client, resp *resty.Response) {
+			errorCode := 0
+			if errResp, ok := resp.Error().(*ErrorResponse); ok {
+				errorCode = errResp.ErrorCode
+			}
+			observe(rd.endpointOf(resp.Request.URL), resp.StatusCode(), errorCode)
+		})
+		rd.client.OnError(func(req *resty.Request, err error) {
+			status := 0
+			if respErr, ok := err.(*resty.ResponseError); ok {
+				status = respErr.Response.StatusCode()
+			}
+			observe(rd.endpointOf(req.URL), status, 0)
+		})
+	}
+}
+
+func New(apiToken string, ipAddress string, opts ...Option) *RealDebrid {
 	client := resty.New().
 		SetBaseURL("https://api.real-debrid.com/rest/1.0").
 		SetHeader("Accept", "application/json").
@@ -55,24 +98,31 @@ func New(apiToken string, ipAddress string) *RealDebrid {
 		})
 	}
 
-	return &RealDebrid{
+	rd := &RealDebrid{
 		client:    client,
 		ipAddress: ipAddress,
 	}
+
+	for _, opt := range opts {
+		opt(rd)
+	}
+
+	return rd
 }
 
-func (rd *RealDebrid) GetFiles(infoHashs []string) (map[string][]*File, error) {
+func (rd *RealDebrid) GetFiles(ctx context.Context, infoHashs []string) (map[string][]*File, error) {
 	result := map[string]safeCatchedTorrentResponse{}
 	resp, err := rd.client.R().
+		SetContext(ctx).
 		SetResult(&result).
 		Get("/torrents/instantAvailability/" + strings.Join(infoHashs, "/"))
 	if err != nil {
-		log.Errorf("Failed to get result from Debrid, err: %v", err)
+		slog.ErrorContext(ctx, "Failed to get result from Debrid", "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to get result from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to get result from Debrid", "error", resp.Error())
 		return nil, resp.Error().(error)
 	}
 
@@ -97,8 +147,30 @@ func (rd *RealDebrid) GetFiles(infoHashs []string) (map[string][]*File, error) {
 	return files, nil
 }
 
-func (rd *RealDebrid) GetDownloadByInfoHash(infoHash string, fileID string) (string, error) {
-	download, err := rd.getDownloadByInfoHash(infoHash, fileID)
+// GetUser returns the account the API token belongs to. It's used to check the token.
+func (rd *RealDebrid) GetUser(ctx context.Context) (*User, error) {
+	user := &User{}
+	resp, err := rd.client.R().
+		SetContext(ctx).
+		SetResult(user).
+		Get("/user")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.IsError() {
+		if errResp, ok := resp.Error().(error); ok {
+			return nil, errResp
+		}
+
+		return nil, fmt.Errorf("realdebrid: unexpected status %d", resp.StatusCode())
+	}
+
+	return user, nil
+}
+
+func (rd *RealDebrid) GetDownloadByInfoHash(ctx context.Context, infoHash string, fileID string) (string, error) {
+	download, err := rd.getDownloadByInfoHash(ctx, infoHash, fileID)
 	if err == nil {
 		return download, nil
 	}
@@ -108,21 +180,21 @@ func (rd *RealDebrid) GetDownloadByInfoHash(infoHash string, fileID string) (str
 	}
 
 	magnetURI := "magnet:?xt=urn:btih:" + infoHash
-	torrentID, err := rd.addMagnet(magnetURI)
+	torrentID, err := rd.addMagnet(ctx, magnetURI)
 	if err != nil {
 		return "", err
 	}
 
-	torrent, err := rd.getTorrent(torrentID)
+	torrent, err := rd.getTorrent(ctx, torrentID)
 	if err != nil {
 		return "", err
 	}
 
-	return rd.getDownload(torrent, fileID)
+	return rd.getDownload(ctx, torrent, fileID)
 }
 
-func (rd *RealDebrid) GetDownloadByMagnetURI(infoHash string, magnetURI string, fileID string) (string, error) {
-	download, err := rd.getDownloadByInfoHash(infoHash, fileID)
+func (rd *RealDebrid) GetDownloadByMagnetURI(ctx context.Context, infoHash string, magnetURI string, fileID string) (string, error) {
+	download, err := rd.getDownloadByInfoHash(ctx, infoHash, fileID)
 	if err == nil {
 		return download, nil
 	}
@@ -131,28 +203,28 @@ func (rd *RealDebrid) GetDownloadByMagnetURI(infoHash string, magnetURI string,
 		return "", err
 	}
 
-	torrentID, err := rd.addMagnet(magnetURI)
+	torrentID, err := rd.addMagnet(ctx, magnetURI)
 	if err != nil {
 		return "", err
 	}
 
-	torrent, err := rd.getTorrent(torrentID)
+	torrent, err := rd.getTorrent(ctx, torrentID)
 	if err != nil {
 		return "", err
 	}
 
-	return rd.getDownload(torrent, fileID)
+	return rd.getDownload(ctx, torrent, fileID)
 }
 
-func (rd *RealDebrid) getDownloadByInfoHash(infoHash, fileID string) (string, error) {
-	torrents, err := rd.getTorrents()
+func (rd *RealDebrid) getDownloadByInfoHash(ctx context.Context, infoHash, fileID string) (string, error) {
+	torrents, err := rd.getTorrents(ctx)
 	if err != nil {
 		return "", err
 	}
 
 	for _, torrent := range torrents {
 		if torrent.Hash == infoHash {
-			download, err := rd.getDownload(&torrent, fileID)
+			download, err := rd.getDownload(ctx, &torrent, fileID)
 			if err == nil {
 				return download, err
 			}
@@ -166,9 +238,10 @@ func (rd *RealDebrid) getDownloadByInfoHash(infoHash, fileID string) (string, er
 	return "", ErrNoTorrentFound
 }
 
-func (rd *RealDebrid) addMagnet(magnetUri string) (string, error) {
+func (rd *RealDebrid) addMagnet(ctx context.Context, magnetUri string) (string, error) {
 	result := &AddMagnetResponse{}
 	resp, err := rd.client.R().
+		SetContext(ctx).
 		SetFormData(map[string]string{
 			"magnet": magnetUri,
 		}).
@@ -176,74 +249,76 @@ func (rd *RealDebrid) addMagnet(magnetUri string) (string, error) {
 		Post("/torrents/addMagnet")
 
 	if err != nil {
-		log.Errorf("Failed to select files on Debrid, err: %v", err)
+		slog.ErrorContext(ctx, "Failed to select files on Debrid", "error", err)
 		return "", err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to get result from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to get result from Debrid", "error", resp.Error())
 		return "", resp.Error().(error)
 	}
 
 	return result.ID, nil
 }
 
-func (rd *RealDebrid) getTorrent(torrentID string) (*Torrent, error) {
+func (rd *RealDebrid) getTorrent(ctx context.Context, torrentID string) (*Torrent, error) {
 	result := &Torrent{}
 	resp, err := rd.client.R().
+		SetContext(ctx).
 		SetResult(result).
 		Get("/torrents/info/" + torrentID)
 
 	if err != nil {
-		log.Errorf("Failed to fetch all torrents: %v", err)
+		slog.ErrorContext(ctx, "Failed to fetch all torrents", "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to get result from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to get result from Debrid", "error", resp.Error())
 		return nil, resp.Error().(error)
 	}
 
 	return result, nil
 }
 
-func (rd *RealDebrid) getTorrents() ([]Torrent, error) {
+func (rd *RealDebrid) getTorrents(ctx context.Context) ([]Torrent, error) {
 	result := []Torrent{}
 	resp, err := rd.client.R().
+		SetContext(ctx).
 		SetResult(&result).
 		SetQueryParam("limit", "200").
 		SetQueryParam("filter", "active").
 		Get("/torrents")
 
 	if err != nil {
-		log.Errorf("Failed to fetch all torrents: %v", err)
+		slog.ErrorContext(ctx, "Failed to fetch all torrents", "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to get torrents from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to get torrents from Debrid", "error", resp.Error())
 		return nil, resp.Error().(error)
 	}
 
 	return result, nil
 }
 
-func (rd *RealDebrid) getDownload(torrent *Torrent, fileID string) (string, error) {
+func (rd *RealDebrid) getDownload(ctx context.Context, torrent *Torrent, fileID string) (string, error) {
 	linkIndex := getIndexOfLinkForFile(torrent, fileID)
 	if torrent.Status == "waiting_files_selection" || linkIndex == -1 {
-		err := rd.selectFileToDownload(torrent.ID)
+		err := rd.selectFileToDownload(ctx, torrent.ID)
 		if err != nil {
 			return "", err
 		}
 
-		torrent, err = rd.getTorrent(torrent.ID)
+		torrent, err = rd.getTorrent(ctx, torrent.ID)
 		if err != nil {
 			return "", err
 		}
 	}
 
 	if torrent.Status != "downloaded" {
-		log.Infof("Torrent status is still %s", torrent.Status)
+		slog.InfoContext(ctx, "The torrent isn't downloaded yet", "status", torrent.Status)
 		return "", ErrTorrentNotReady
 	}
 
@@ -253,11 +328,11 @@ func (rd *RealDebrid) getDownload(torrent *Torrent, fileID string) (string, erro
 	}
 
 	if len(torrent.Links) == 0 || len(torrent.Links) <= linkIndex {
-		log.Infof("Invalid torrent link: %d, len: %d", linkIndex, len(torrent.Links))
+		slog.WarnContext(ctx, "Invalid torrent link", "index", linkIndex, "links", len(torrent.Links))
 		return "", errors.New("not supported")
 	}
 
-	download, err := rd.generateDownload(torrent.Links[linkIndex])
+	download, err := rd.generateDownload(ctx, torrent.Links[linkIndex])
 	if err != nil {
 		return "", err
 	}
@@ -265,43 +340,43 @@ func (rd *RealDebrid) getDownload(torrent *Torrent, fileID string) (string, erro
 	return download, nil
 }
 
-func (rd *RealDebrid) generateDownload(hosterLink string) (string, error) {
+func (rd *RealDebrid) generateDownload(ctx context.Context, hosterLink string) (string, error) {
 	result := &UnrestrictedLinkResp{}
 	resp, err := rd.client.R().
+		SetContext(ctx).
 		SetResult(&result).
-		SetDebug(true).
 		SetFormData(map[string]string{
 			"link": hosterLink,
 		}).
 		Post("/unrestrict/link")
 
 	if err != nil {
-		log.Errorf("Failed to generate unrestricted link: %v", err)
+		slog.ErrorContext(ctx, "Failed to generate unrestricted link", "error", err)
 		return "", err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to generate download link from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to generate download link from Debrid", "error", resp.Error())
 		return "", resp.Error().(error)
 	}
 
 	return result.Download, nil
 }
 
-func (rd *RealDebrid) selectFileToDownload(torrentID string) error {
+func (rd *RealDebrid) selectFileToDownload(ctx context.Context, torrentID string) error {
 	resp, err := rd.client.R().
-		SetDebug(true).
+		SetContext(ctx).
 		SetFormData(map[string]string{
 			"files": "all",
 		}).
 		Post("/torrents/selectFiles/" + torrentID)
 	if err != nil {
-		log.Errorf("Failed to select files on Debrid, err: %v", err)
+		slog.ErrorContext(ctx, "Failed to select files on Debrid", "error", err)
 		return err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to select files from Debrid, err: %v", resp.Error())
+		slog.ErrorContext(ctx, "Failed to select files from Debrid", "error", resp.Error())
 		return resp.Error().(error)
 	}
 
@@ -345,6 +420,14 @@ type TorrentFile struct {
 	Bytes    int    `json:"bytes"`
 }
 
+type User struct {
+	ID         int    `json:"id"`
+	Username   string `json:"username"`
+	Type       string `json:"type"`
+	Premium    int    `json:"premium"`
+	Expiration string `json:"expiration"`
+}
+
 type UnrestrictedLinkResp struct {
 	Download string `json:"download"`
 }
@@ -357,3 +440,19 @@ type ErrorResponse struct {
 func (er ErrorResponse) Error() string {
 	return fmt.Sprintf("[%s,%d]", er.ErrTxt, er.ErrorCode)
 }
+
+// endpointOf strips the base URL, IDs and info hashes from the URL of a request,
+// e.g. "https://api.real-debrid.com/rest/1.0/torrents/info/ID" becomes "/torrents/info".
+func (rd *RealDebrid) endpointOf(rawURL string) string {
+	path := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		path = parsed.Path
+	}
+
+	if base, err := url.Parse(rd.client.BaseURL); err == nil {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(base.Path, "/"))
+	}
+
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	return "/" + strings.Join(segments[:min(len(segments), 2)], "/")
+}
@@ -0,0 +1,41 @@
+package realdebrid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRealDebrid_RequestObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"bad_token","error_code":8}`))
+	}))
+	defer server.Close()
+
+	type request struct {
+		endpoint  string
+		status    int
+		errorCode int
+	}
+	requests := []request{}
+	rd := New("token", "", WithRequestObserver(func(endpoint string, status int, errorCode int) {
+		requests = append(requests, request{endpoint, status, errorCode})
+	}), WithBaseURL(server.URL))
+
+	_, err := rd.getTorrent(context.Background(), "ABCDEF")
+	require.Error(t, err)
+
+	server.Close()
+	_, err = rd.GetUser(context.Background())
+	require.Error(t, err)
+
+	require.Equal(t, []request{
+		{endpoint: "/torrents/info", status: http.StatusUnauthorized, errorCode: 8},
+		{endpoint: "/user", status: 0, errorCode: 0},
+	}, requests)
+}
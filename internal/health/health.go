@@ -0,0 +1,189 @@
+// Package health tracks how indexers behave and stops querying those which keep failing.
+package health
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultCoolDown         = 5 * time.Minute
+	// latencyWeight is the weight of the latest request in the moving average of latencies.
+	latencyWeight = 0.2
+	// Stats of indexers which haven't been used for idleTimeout are dropped, as the Prowlarr instances
+	// come from user data. They're swept at most once per cleanupInterval.
+	idleTimeout     = time.Hour
+	cleanupInterval = time.Minute
+)
+
+type Config struct {
+	// FailureThreshold is the number of failures in a row which opens the circuit of an indexer.
+	FailureThreshold int
+	// CoolDown is how long an indexer is skipped once its circuit is open.
+	CoolDown time.Duration
+}
+
+// IndexerStats are the health stats of an indexer of a Prowlarr instance.
+type IndexerStats struct {
+	Prowlarr            string        `json:"prowlarr"`
+	ID                  int           `json:"id"`
+	Name                string        `json:"name"`
+	Requests            int           `json:"requests"`
+	Failures            int           `json:"failures"`
+	ErrorRate           float64       `json:"errorRate"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	AverageLatency      time.Duration `json:"averageLatency"`
+	LastFailure         time.Time     `json:"lastFailure,omitempty"`
+	LastError           string        `json:"lastError,omitempty"`
+	// SkippedUntil is when the circuit closes again, zero if it isn't open.
+	SkippedUntil time.Time `json:"skippedUntil,omitempty"`
+	// DisabledUntil is when Prowlarr enables the indexer again, zero if it isn't disabled.
+	DisabledUntil time.Time `json:"disabledUntil,omitempty"`
+
+	lastSeen time.Time
+}
+
+type indexerKey struct {
+	prowlarr string
+	id       int
+}
+
+// Tracker keeps the health stats of indexers and acts as a circuit breaker for them.
+type Tracker struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	stats       map[indexerKey]*IndexerStats
+	lastCleanup time.Time
+}
+
+func New(cfg Config) *Tracker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = defaultCoolDown
+	}
+
+	return &Tracker{
+		cfg:   cfg,
+		now:   time.Now,
+		stats: map[indexerKey]*IndexerStats{},
+	}
+}
+
+// Allow reports whether the indexer should be queried. Once the cool-down has passed,
+// the indexer is tried again and a single failure opens the circuit again.
+func (t *Tracker) Allow(prowlarr string, id int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.stats[indexerKey{prowlarr, id}]
+	if !ok {
+		return true
+	}
+
+	now := t.now()
+	return !now.Before(s.SkippedUntil) && !now.Before(s.DisabledUntil)
+}
+
+// Record adds the outcome of a request to an indexer.
+func (t *Tracker) Record(prowlarr string, id int, name string, latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.get(prowlarr, id, name)
+	s.Requests++
+	if s.AverageLatency == 0 {
+		s.AverageLatency = latency
+	} else {
+		s.AverageLatency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(s.AverageLatency))
+	}
+
+	if err == nil {
+		s.ConsecutiveFailures = 0
+		s.SkippedUntil = time.Time{}
+	} else {
+		now := t.now()
+		s.Failures++
+		s.ConsecutiveFailures++
+		s.LastFailure = now
+		s.LastError = err.Error()
+		if s.ConsecutiveFailures >= t.cfg.FailureThreshold {
+			s.SkippedUntil = now.Add(t.cfg.CoolDown)
+		}
+	}
+
+	s.ErrorRate = float64(s.Failures) / float64(s.Requests)
+}
+
+// SetDisabledUntil records until when Prowlarr has disabled an indexer, as reported by /api/v1/indexerstatus.
+func (t *Tracker) SetDisabledUntil(prowlarr string, id int, name string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.get(prowlarr, id, name).DisabledUntil = until
+}
+
+// Snapshot returns a copy of the stats of all indexers seen so far.
+func (t *Tracker) Snapshot() []IndexerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make([]IndexerStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		snapshot = append(snapshot, *s)
+	}
+
+	slices.SortFunc(snapshot, func(a, b IndexerStats) int {
+		if a.Prowlarr != b.Prowlarr {
+			if a.Prowlarr < b.Prowlarr {
+				return -1
+			}
+			return 1
+		}
+
+		return a.ID - b.ID
+	})
+	return snapshot
+}
+
+func (t *Tracker) get(prowlarr string, id int, name string) *IndexerStats {
+	now := t.now()
+	t.cleanup(now)
+
+	key := indexerKey{prowlarr, id}
+	s, ok := t.stats[key]
+	if !ok {
+		s = &IndexerStats{
+			Prowlarr: prowlarr,
+			ID:       id,
+		}
+		t.stats[key] = s
+	}
+
+	if name != "" {
+		s.Name = name
+	}
+
+	s.lastSeen = now
+	return s
+}
+
+// cleanup drops idle stats, unless the indexer is still skipped.
+func (t *Tracker) cleanup(now time.Time) {
+	if now.Sub(t.lastCleanup) < cleanupInterval {
+		return
+	}
+
+	t.lastCleanup = now
+	for key, s := range t.stats {
+		if now.Sub(s.lastSeen) > idleTimeout && !now.Before(s.SkippedUntil) && !now.Before(s.DisabledUntil) {
+			delete(t.stats, key)
+		}
+	}
+}
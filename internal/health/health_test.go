@@ -0,0 +1,73 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Now()
+	tracker := New(Config{FailureThreshold: 2, CoolDown: time.Minute})
+	tracker.now = func() time.Time { return now }
+	errTimeout := errors.New("timeout")
+
+	t.Run("should open the circuit after failures in a row", func(t *testing.T) {
+		tracker.Record("http://prowlarr", 1, "first", time.Second, errTimeout)
+		require.True(t, tracker.Allow("http://prowlarr", 1))
+
+		tracker.Record("http://prowlarr", 1, "first", time.Second, errTimeout)
+		require.False(t, tracker.Allow("http://prowlarr", 1))
+		require.True(t, tracker.Allow("http://other", 1))
+	})
+
+	t.Run("should try again after the cool-down", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		require.True(t, tracker.Allow("http://prowlarr", 1))
+
+		// a single failure opens the circuit again
+		tracker.Record("http://prowlarr", 1, "first", time.Second, errTimeout)
+		require.False(t, tracker.Allow("http://prowlarr", 1))
+
+		now = now.Add(time.Minute)
+		tracker.Record("http://prowlarr", 1, "first", time.Second, nil)
+		require.True(t, tracker.Allow("http://prowlarr", 1))
+	})
+
+	t.Run("should skip indexers disabled by Prowlarr", func(t *testing.T) {
+		tracker.SetDisabledUntil("http://prowlarr", 2, "second", now.Add(time.Hour))
+		require.False(t, tracker.Allow("http://prowlarr", 2))
+
+		now = now.Add(time.Hour)
+		require.True(t, tracker.Allow("http://prowlarr", 2))
+	})
+
+	t.Run("should report the stats", func(t *testing.T) {
+		snapshot := tracker.Snapshot()
+		require.Len(t, snapshot, 2)
+
+		first := snapshot[0]
+		require.Equal(t, "first", first.Name)
+		require.Equal(t, 4, first.Requests)
+		require.Equal(t, 3, first.Failures)
+		require.Equal(t, 0.75, first.ErrorRate)
+		require.Equal(t, time.Second, first.AverageLatency)
+		require.Equal(t, "timeout", first.LastError)
+		require.Equal(t, "second", snapshot[1].Name)
+	})
+
+	t.Run("should drop the stats of idle indexers", func(t *testing.T) {
+		tracker.SetDisabledUntil("http://prowlarr", 3, "third", now.Add(2*time.Hour))
+		now = now.Add(90 * time.Minute)
+		tracker.Record("http://other", 1, "other", time.Second, nil)
+
+		// the third indexer is idle but still disabled
+		names := []string{}
+		for _, s := range tracker.Snapshot() {
+			names = append(names, s.Name)
+		}
+		require.Equal(t, []string{"other", "third"}, names)
+	})
+}
@@ -0,0 +1,152 @@
+// Package logging sets up the structured logger of the server.
+// Records carry the ID of the request they were logged for and attributes holding secrets are redacted.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// The formats of log records.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Redacted replaces the values of secrets.
+const Redacted = "[REDACTED]"
+
+// RequestIDKey is the attribute of the request ID.
+const RequestIDKey = "request_id"
+
+type Config struct {
+	// Format is either json or text, json by default.
+	Format string
+	// Level is one of debug, info, warn or error, info by default.
+	Level string
+}
+
+var (
+	// secretKeys are attributes whose values are always redacted, compared after normalizeKey.
+	secretKeys = map[string]bool{
+		"apikey":        true,
+		"key":           true,
+		"token":         true,
+		"secret":        true,
+		"password":      true,
+		"authorization": true,
+		"userdata":      true,
+		"rd":            true,
+		"pkey":          true,
+	}
+	// secretSuffixes match attributes such as prowlarr_api_key or admin_token.
+	secretSuffixes = []string{"apikey", "token", "secret", "password"}
+
+	// secretPattern finds secrets embedded in strings, e.g. the apikey parameter of Prowlarr download links.
+	secretPattern = regexp.MustCompile(`(?i)((?:api_?key|access_token|token|secret|password)=|bearer\s+)[^&\s"']+`)
+)
+
+// New creates a logger writing to w.
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	return slog.New(&handler{Handler: h}), nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID,
+// records logged with it or with a context derived from it have the ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of ctx, empty if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// handler adds the request ID of the context to records.
+type handler struct {
+	slog.Handler
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String(RequestIDKey, id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name)}
+}
+
+// redact hides the values of secret attributes and the secrets embedded in strings and errors.
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if isSecret(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(Scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(Scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+func isSecret(key string) bool {
+	key = normalizeKey(key)
+	if secretKeys[key] {
+		return true
+	}
+
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// Scrub redacts secrets embedded in s, e.g. API keys in query strings and bearer tokens.
+func Scrub(s string) string {
+	return secretPattern.ReplaceAllString(s, "${1}"+Redacted)
+}
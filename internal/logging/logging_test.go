@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		record := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogger(t *testing.T) {
+	t.Run("should redact secrets", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger, err := New(buf, Config{})
+		require.NoError(t, err)
+
+		logger.Info("Searching",
+			"rd", "rd-key",
+			"prowlarr_api_key", "prowlarr-key",
+			"AdminToken", "admin-token",
+			"link", "http://prowlarr/1/download?apikey=prowlarr-key&file=a",
+			slog.Group("user", "pKey", "p-key"),
+			"error", errors.New(`Get "https://api.themoviedb.org/3/find/tt1?api_key=tmdb-key": timeout`),
+		)
+
+		out := buf.String()
+		for _, secret := range []string{"rd-key", "prowlarr-key", "admin-token", "p-key", "tmdb-key"} {
+			require.NotContains(t, out, secret)
+		}
+
+		record := decodeRecords(t, buf)[0]
+		require.Equal(t, Redacted, record["rd"])
+		require.Equal(t, "http://prowlarr/1/download?apikey=[REDACTED]&file=a", record["link"])
+		require.Equal(t, map[string]any{"pKey": Redacted}, record["user"])
+	})
+
+	t.Run("should add request IDs", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger, err := New(buf, Config{Format: FormatJSON})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(WithRequestID(context.Background(), "req-1"))
+		defer cancel()
+		logger.With("stage", "search").InfoContext(ctx, "Found")
+		logger.Info("Started")
+
+		records := decodeRecords(t, buf)
+		require.Equal(t, "req-1", records[0][RequestIDKey])
+		require.Equal(t, "search", records[0]["stage"])
+		require.NotContains(t, records[1], RequestIDKey)
+	})
+
+	t.Run("should filter by level", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger, err := New(buf, Config{Format: FormatText, Level: "WARN"})
+		require.NoError(t, err)
+
+		logger.Info("hidden")
+		logger.Warn("shown", "token", "t")
+		require.NotContains(t, buf.String(), "hidden")
+		require.Contains(t, buf.String(), "msg=shown token=[REDACTED]")
+	})
+
+	t.Run("should reject invalid configs", func(t *testing.T) {
+		_, err := New(&bytes.Buffer{}, Config{Format: "xml"})
+		require.Error(t, err)
+
+		_, err = New(&bytes.Buffer{}, Config{Level: "verbose"})
+		require.Error(t, err)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, Config{})
+	require.NoError(t, err)
+
+	app := fiber.New()
+	app.Use(Middleware(logger, func(path string) string {
+		return strings.Replace(path, "secret", "***", 1)
+	}))
+	app.Get("/:userData/stream", func(c *fiber.Ctx) error {
+		logger.InfoContext(c.UserContext(), "Streaming")
+		return fiber.ErrBadGateway
+	})
+
+	t.Run("should generate request IDs and log requests", func(t *testing.T) {
+		buf.Reset()
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/secret/stream", nil))
+		require.NoError(t, err)
+
+		id := resp.Header.Get(fiber.HeaderXRequestID)
+		require.NotEmpty(t, id)
+
+		records := decodeRecords(t, buf)
+		require.Len(t, records, 2)
+		require.Equal(t, id, records[0][RequestIDKey])
+		require.Equal(t, id, records[1][RequestIDKey])
+		require.Equal(t, "/***/stream", records[1]["path"])
+		require.Equal(t, float64(fiber.StatusBadGateway), records[1]["status"])
+		require.Equal(t, "ERROR", records[1]["level"])
+	})
+
+	t.Run("should keep well-formed request IDs of clients", func(t *testing.T) {
+		req := httptest.NewRequest(fiber.MethodGet, "/secret/stream", nil)
+		req.Header.Set(fiber.HeaderXRequestID, "client-id")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, "client-id", resp.Header.Get(fiber.HeaderXRequestID))
+
+		req = httptest.NewRequest(fiber.MethodGet, "/secret/stream", nil)
+		req.Header.Set(fiber.HeaderXRequestID, "bad id\"")
+		resp, err = app.Test(req)
+		require.NoError(t, err)
+		require.NotEqual(t, "bad id\"", resp.Header.Get(fiber.HeaderXRequestID))
+	})
+}
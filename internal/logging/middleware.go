@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// maxRequestIDLength limits request IDs sent by clients.
+const maxRequestIDLength = 64
+
+var requestIDPattern = regexp.MustCompile(`^[\w.-]+$`)
+
+// Middleware assigns an ID to each request, carries it by the user context and logs the request once it's handled.
+// Request IDs sent by clients via X-Request-ID are kept if they're well-formed.
+// maskPath hides secrets of paths, e.g. user data, before they're logged.
+func Middleware(logger *slog.Logger, maskPath func(path string) string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// copied as the ID outlives the request in goroutines of pipelines
+		id := utils.CopyString(c.Get(fiber.HeaderXRequestID))
+		if len(id) > maxRequestIDLength || !requestIDPattern.MatchString(id) {
+			id = utils.UUIDv4()
+		}
+
+		c.Set(fiber.HeaderXRequestID, id)
+		ctx := WithRequestID(c.UserContext(), id)
+		c.SetUserContext(ctx)
+
+		startedAt := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		path := c.Path()
+		if maskPath != nil {
+			path = maskPath(path)
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("path", path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(startedAt)),
+			slog.String("ip", c.IP()),
+		}
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		}
+
+		logger.LogAttrs(ctx, level, "request", attrs...)
+		return err
+	}
+}
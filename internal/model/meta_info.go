@@ -5,4 +5,18 @@ type MetaInfo struct {
 	FromYear int
 	ToYear   int
 	IMDBID   uint
+	// Aliases are other titles, e.g. the original one, releases may be named after.
+	Aliases []string
+
+	// The fields below are only set by metadata providers which know them.
+	TMDBID           uint
+	TVDBID           uint
+	OriginalLanguage string
+	// EpisodeYear is the year the requested episode was aired.
+	EpisodeYear int
+}
+
+// Titles returns the name followed by the aliases.
+func (m *MetaInfo) Titles() []string {
+	return append([]string{m.Name}, m.Aliases...)
 }
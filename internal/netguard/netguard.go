@@ -0,0 +1,225 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedDestination = errors.New("netguard: destination is not allowed")
+	ErrBlockedScheme      = errors.New("netguard: scheme is not allowed")
+
+	defaultSchemes = []string{"http", "https"}
+
+	// metadataAddrs are cloud metadata endpoints which are never reachable through the guard.
+	metadataAddrs = []netip.Addr{
+		netip.MustParseAddr("169.254.169.254"), // AWS, GCP, Azure, DigitalOcean...
+		netip.MustParseAddr("fd00:ec2::254"),   // AWS IPv6
+		netip.MustParseAddr("100.100.100.200"), // Alibaba Cloud
+		netip.MustParseAddr("168.63.129.16"),   // Azure wire server
+	}
+
+	// sharedAddrSpace is the carrier-grade NAT range of RFC 6598, internal like private networks.
+	sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+type Config struct {
+	// AllowedCIDRs restricts outbound connections to these networks when it's not empty.
+	// Loopback, private and shared networks are denied unless they're listed.
+	AllowedCIDRs []string
+	// DeniedCIDRs are never dialed, even if they're allowed.
+	DeniedCIDRs []string
+	// AllowedSchemes defaults to http and https.
+	AllowedSchemes []string
+	// TrustedHosts are host:port pairs dialed without any IP check, e.g. the Prowlarr configured by the operator.
+	TrustedHosts []string
+}
+
+// Policy decides which destinations outbound HTTP clients may connect to.
+// Checks happen on the resolved IP right before dialing, so DNS rebinding can't bypass them.
+type Policy struct {
+	allowed      []netip.Prefix
+	denied       []netip.Prefix
+	schemes      []string
+	trustedHosts []string
+}
+
+func New(cfg Config) (*Policy, error) {
+	allowed, err := parsePrefixes(cfg.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := parsePrefixes(cfg.DeniedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	schemes := defaultSchemes
+	if len(cfg.AllowedSchemes) > 0 {
+		schemes = make([]string, 0, len(cfg.AllowedSchemes))
+		for _, scheme := range cfg.AllowedSchemes {
+			schemes = append(schemes, strings.ToLower(strings.TrimSpace(scheme)))
+		}
+	}
+
+	trustedHosts := make([]string, 0, len(cfg.TrustedHosts))
+	for _, hostPort := range cfg.TrustedHosts {
+		hostPort = strings.TrimSpace(hostPort)
+		if hostPort == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("netguard: trusted host %q must be host:port", hostPort)
+		}
+		trustedHosts = append(trustedHosts, net.JoinHostPort(strings.ToLower(host), port))
+	}
+
+	return &Policy{
+		allowed:      allowed,
+		denied:       denied,
+		schemes:      schemes,
+		trustedHosts: trustedHosts,
+	}, nil
+}
+
+// CheckScheme returns an error if requests with the scheme aren't allowed.
+func (p *Policy) CheckScheme(scheme string) error {
+	if !slices.Contains(p.schemes, strings.ToLower(scheme)) {
+		return fmt.Errorf("%w: %s", ErrBlockedScheme, scheme)
+	}
+
+	return nil
+}
+
+// CheckAddr returns an error if connections to addr aren't allowed.
+// Internal networks are only reachable if AllowedCIDRs lists them.
+func (p *Policy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsUnspecified() || slices.Contains(metadataAddrs, addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+
+	if containsAddr(p.denied, addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+
+	if containsAddr(p.allowed, addr) {
+		return nil
+	}
+
+	if len(p.allowed) > 0 || isInternal(addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+
+	return nil
+}
+
+func isInternal(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || sharedAddrSpace.Contains(addr)
+}
+
+// Transport returns a connection-pooling transport which enforces the policy.
+// It should be shared between clients.
+func (p *Policy) Transport() http.RoundTripper {
+	return &guardedTransport{
+		policy: p,
+		base: &http.Transport{
+			DialContext:           p.dialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			// clients without their own timeout, e.g. the stream proxy, mustn't wait forever on a stalled upstream
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+}
+
+func (p *Policy) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if !slices.Contains(p.trustedHosts, net.JoinHostPort(strings.ToLower(host), port)) {
+		dialer.Control = p.control
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// control is called with the resolved address of every connection attempt.
+func (p *Policy) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, host)
+	}
+
+	return p.CheckAddr(addr)
+}
+
+type guardedTransport struct {
+	policy *Policy
+	base   http.RoundTripper
+}
+
+// RoundTrip checks the scheme of every request, including the ones following redirects.
+func (t *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.CheckScheme(req.URL.Scheme); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("netguard: invalid CIDR %q: %v", cidr, err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,155 @@
+package netguard_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/bongnv/prowlarr-stremio/internal/netguard"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_CheckAddr(t *testing.T) {
+	policy, err := netguard.New(netguard.Config{
+		AllowedCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16", "169.254.0.0/16"},
+		DeniedCIDRs:  []string{"10.1.0.0/16"},
+	})
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		addr    string
+		allowed bool
+	}{
+		"should allow allowed networks":      {addr: "10.0.0.1", allowed: true},
+		"should deny denied networks":        {addr: "10.1.2.3", allowed: false},
+		"should deny networks not allowed":   {addr: "8.8.8.8", allowed: false},
+		"should always deny metadata IPs":    {addr: "169.254.169.254", allowed: false},
+		"should always deny link-local IPs":  {addr: "169.254.1.1", allowed: false},
+		"should deny IPv4-mapped IPv6 addrs": {addr: "::ffff:10.1.2.3", allowed: false},
+		"should deny unspecified addrs":      {addr: "0.0.0.0", allowed: false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := policy.CheckAddr(netip.MustParseAddr(tc.addr))
+			if tc.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, netguard.ErrBlockedDestination)
+			}
+		})
+	}
+}
+
+func TestPolicy_CheckAddr_Defaults(t *testing.T) {
+	policy, err := netguard.New(netguard.Config{})
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		addr    string
+		allowed bool
+	}{
+		"should allow public IPv4 addrs":   {addr: "8.8.8.8", allowed: true},
+		"should allow public IPv6 addrs":   {addr: "2606:4700:4700::1111", allowed: true},
+		"should deny loopback addrs":       {addr: "127.0.0.1", allowed: false},
+		"should deny IPv6 loopback addrs":  {addr: "::1", allowed: false},
+		"should deny 10/8":                 {addr: "10.0.0.5", allowed: false},
+		"should deny 172.16/12":            {addr: "172.16.0.1", allowed: false},
+		"should deny 192.168/16":           {addr: "192.168.1.1", allowed: false},
+		"should deny CGNAT addrs":          {addr: "100.64.0.1", allowed: false},
+		"should deny ULA addrs":            {addr: "fd00::1", allowed: false},
+		"should deny mapped private addrs": {addr: "::ffff:10.0.0.5", allowed: false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := policy.CheckAddr(netip.MustParseAddr(tc.addr))
+			if tc.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, netguard.ErrBlockedDestination)
+			}
+		})
+	}
+}
+
+func TestPolicy_Transport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "ftp://example.com/file", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	t.Run("should block denied destinations when dialing", func(t *testing.T) {
+		policy, err := netguard.New(netguard.Config{
+			DeniedCIDRs: []string{"127.0.0.0/8"},
+		})
+		require.NoError(t, err)
+
+		_, err = resty.New().SetTransport(policy.Transport()).R().Get(server.URL)
+		require.ErrorIs(t, err, netguard.ErrBlockedDestination)
+	})
+
+	t.Run("should block loopback destinations by default", func(t *testing.T) {
+		policy, err := netguard.New(netguard.Config{})
+		require.NoError(t, err)
+
+		_, err = resty.New().SetTransport(policy.Transport()).R().Get(server.URL)
+		require.ErrorIs(t, err, netguard.ErrBlockedDestination)
+	})
+
+	t.Run("should allow trusted hosts", func(t *testing.T) {
+		policy, err := netguard.New(netguard.Config{
+			DeniedCIDRs:  []string{"127.0.0.0/8"},
+			TrustedHosts: []string{serverURL.Host},
+		})
+		require.NoError(t, err)
+
+		resp, err := resty.New().SetTransport(policy.Transport()).R().Get(server.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode())
+	})
+
+	t.Run("should block other ports of trusted hosts", func(t *testing.T) {
+		policy, err := netguard.New(netguard.Config{
+			TrustedHosts: []string{serverURL.Hostname() + ":1"},
+		})
+		require.NoError(t, err)
+
+		_, err = resty.New().SetTransport(policy.Transport()).R().Get(server.URL)
+		require.ErrorIs(t, err, netguard.ErrBlockedDestination)
+	})
+
+	t.Run("should block redirects to schemes not allowed", func(t *testing.T) {
+		policy, err := netguard.New(netguard.Config{
+			AllowedCIDRs: []string{"127.0.0.0/8"},
+		})
+		require.NoError(t, err)
+
+		_, err = resty.New().SetTransport(policy.Transport()).R().Get(server.URL + "/redirect")
+		require.ErrorIs(t, err, netguard.ErrBlockedScheme)
+	})
+
+	t.Run("should reject invalid CIDRs", func(t *testing.T) {
+		_, err := netguard.New(netguard.Config{
+			AllowedCIDRs: []string{"not a cidr"},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("should reject trusted hosts without port", func(t *testing.T) {
+		_, err := netguard.New(netguard.Config{
+			TrustedHosts: []string{serverURL.Hostname()},
+		})
+		require.Error(t, err)
+	})
+}
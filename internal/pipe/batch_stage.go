@@ -1,61 +1,100 @@
 package pipe
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 const (
 	defaultBatchSize  = 10
+	defaultMinSize    = 1
 	defaultWorkerSize = 2
 )
 
 type batchStage[R any] struct {
-	fn          func(r []*R) ([]*R, error)
-	workerSize  int
-	batchSize   int
-	reportError func(err error)
-	stoped      <-chan struct{}
-	batchCh     chan []*R
+	stageBase
+	fn         func(ctx context.Context, r []*R) ([]*R, error)
+	workerSize int
+	batchSize  int
+	minSize    int
+	maxWait    time.Duration
+	batchCh    chan []*R
+}
+
+type BatchStageOption[R any] interface {
+	applyBatch(s *batchStage[R])
 }
 
-type BatchStageOption[R any] func(p *batchStage[R])
+type batchStageOption[R any] func(s *batchStage[R])
+
+func (o batchStageOption[R]) applyBatch(s *batchStage[R]) { o(s) }
 
 func WorkerSize[R any](workerSize int) BatchStageOption[R] {
-	return func(p *batchStage[R]) {
+	return batchStageOption[R](func(p *batchStage[R]) {
 		p.workerSize = workerSize
-	}
+	})
+}
+
+// BatchSize sets the maximum number of records in a batch.
+func BatchSize[R any](batchSize int) BatchStageOption[R] {
+	return batchStageOption[R](func(p *batchStage[R]) {
+		p.batchSize = batchSize
+	})
+}
+
+// MinSize holds a batch back until it has at least minSize records, the pipe is drained or MaxWait has passed.
+func MinSize[R any](minSize int) BatchStageOption[R] {
+	return batchStageOption[R](func(p *batchStage[R]) {
+		p.minSize = minSize
+	})
+}
+
+// MaxWait flushes a batch once maxWait has passed since its first record arrived, whatever its size.
+func MaxWait[R any](maxWait time.Duration) BatchStageOption[R] {
+	return batchStageOption[R](func(p *batchStage[R]) {
+		p.maxWait = maxWait
+	})
 }
 
-func (s *batchStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
+func (s *batchStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
 	defer close(outCh)
+	defer s.track()()
 
 	wg := &sync.WaitGroup{}
 	for i := 0; i < s.workerSize; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		s.spawn(wg, func() {
 			for batch := range s.batchCh {
-				outs, err := s.fn(batch)
-				if err != nil {
-					s.reportError(err)
+				var outs []*R
+				ok := s.call(ctx, func() (err error) {
+					outs, err = s.fn(ctx, batch)
+					return err
+				})
+				if !ok {
 					return
-				} else {
-					SendRecords(outs, outCh, s.stoped)
 				}
+
+				for i := len(outs); i < len(batch); i++ {
+					s.observer.RecordDropped(s.name)
+				}
+				SendRecords(ctx, outs, outCh)
+				s.observer.RecordsOut(s.name, len(outs))
 			}
-		}()
+		})
 	}
 
-	wg.Add(1)
-	go s.batchRecords(wg, inCh)
+	s.spawn(wg, func() {
+		s.batchRecords(ctx, inCh)
+	})
 
 	wg.Wait()
 }
 
-func (s *batchStage[R]) batchRecords(wg *sync.WaitGroup, inCh <-chan *R) {
-	defer wg.Done()
+func (s *batchStage[R]) batchRecords(ctx context.Context, inCh <-chan *R) {
 	defer close(s.batchCh)
 	for {
 		select {
-		case <-s.stoped:
+		case <-ctx.Done():
 			return
 		default:
 			select {
@@ -65,56 +104,86 @@ func (s *batchStage[R]) batchRecords(wg *sync.WaitGroup, inCh <-chan *R) {
 					return
 				}
 
-				s.processNextBatch(record, inCh)
-			case <-s.stoped:
+				s.observer.RecordIn(s.name)
+				s.processNextBatch(ctx, record, inCh)
+			case <-ctx.Done():
 				return
 			}
 		}
 	}
 }
 
-func (s *batchStage[R]) processNextBatch(r *R, inCh <-chan *R) {
+// processNextBatch collects a batch starting with r. The batch is flushed once it's full, once inCh is closed,
+// once maxWait has passed since r arrived, or earlier when a worker is idle and the batch has minSize records.
+func (s *batchStage[R]) processNextBatch(ctx context.Context, r *R, inCh <-chan *R) {
 	newBatch := make([]*R, 0, s.batchSize)
 	newBatch = append(newBatch, r)
-	shouldDrain := false
+
+	var deadline <-chan time.Time
+	if s.maxWait > 0 {
+		timer := s.clock.NewTimer(s.maxWait)
+		defer timer.Stop()
+		deadline = timer.C()
+	}
+
 	for {
-		if len(newBatch) == s.batchSize || shouldDrain {
-			select {
-			case <-s.stoped:
-			default:
-				// not stopped, try to queue the next batch
-				select {
-				case s.batchCh <- newBatch:
-				case <-s.stoped:
-				}
-			}
+		s.observer.QueueDepth(s.name, len(newBatch))
+		if len(newBatch) >= s.batchSize {
+			s.flush(ctx, newBatch)
 			return
 		}
 
+		// prefer growing the batch while records are ready
 		select {
 		case record, ok := <-inCh:
 			if !ok {
 				// inCh is closed
-				shouldDrain = true
-				continue
+				s.flush(ctx, newBatch)
+				return
 			}
 
+			s.observer.RecordIn(s.name)
 			newBatch = append(newBatch, record)
+			continue
 		default:
-			select {
-			case record, ok := <-inCh:
-				if !ok {
-					// inCh is closed
-					shouldDrain = true
-					continue
-				}
+		}
 
-				newBatch = append(newBatch, record)
-			case s.batchCh <- newBatch:
-				return
-			case <-s.stoped:
+		// a nil channel blocks, so the batch isn't offered to idle workers until it's big enough
+		var batchCh chan<- []*R
+		if len(newBatch) >= s.minSize {
+			batchCh = s.batchCh
+		}
+
+		select {
+		case record, ok := <-inCh:
+			if !ok {
+				// inCh is closed
+				s.flush(ctx, newBatch)
 				return
 			}
+
+			s.observer.RecordIn(s.name)
+			newBatch = append(newBatch, record)
+		case batchCh <- newBatch:
+			return
+		case <-deadline:
+			s.flush(ctx, newBatch)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush queues the batch unless the pipe is stopped.
+func (s *batchStage[R]) flush(ctx context.Context, batch []*R) {
+	select {
+	case <-ctx.Done():
+	default:
+		// not stopped, try to queue the batch
+		select {
+		case s.batchCh <- batch:
+		case <-ctx.Done():
 		}
 	}
 }
@@ -1,36 +1,66 @@
 package pipe
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 const (
 	defaultChannelConcurrency = 10
 )
 
 type channelStage[R any] struct {
-	fn          func(r *R, stopCh <-chan struct{}, outCh chan<- *R) error
+	stageBase
+	fn          func(ctx context.Context, r *R, outCh chan<- *R) error
 	concurrency int
-	reportError func(err error)
-	stopped     <-chan struct{}
 }
 
-func (s *channelStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
+type ChannelStageOption[R any] interface {
+	applyChannel(s *channelStage[R])
+}
+
+func (s *channelStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
 	defer close(outCh)
+	defer s.track()()
+
+	// fnOutCh lets the stage count records sent by fn.
+	fnOutCh := make(chan *R)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		s.guard(func() {
+			for r := range fnOutCh {
+				select {
+				case outCh <- r:
+					s.observer.RecordsOut(s.name, 1)
+				case <-ctx.Done():
+				}
+			}
+		})
+
+		// after a panic, records are still drained so fn doesn't block
+		for range fnOutCh {
+		}
+	}()
 
 	wg := &sync.WaitGroup{}
 	for i := 0; i < s.concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		s.spawn(wg, func() {
 			for r := range inCh {
-				err := s.fn(r, s.stopped, outCh)
-				if err != nil {
-					s.reportError(err)
+				s.observer.RecordIn(s.name)
+				s.observer.QueueDepth(s.name, len(inCh))
+				ok := s.call(ctx, func() error {
+					return s.fn(ctx, r, fnOutCh)
+				})
+				if !ok {
 					return
 				}
 			}
-		}()
+		})
 	}
 	wg.Wait()
+	close(fnOutCh)
+	<-forwarded
 }
 
 func (s *channelStage[R]) getBufSize() int {
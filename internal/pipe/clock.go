@@ -0,0 +1,49 @@
+package pipe
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time to a pipe and its stages. It's replaced in tests to control time, see pipetest.Clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// WithTimeout returns a copy of ctx which is cancelled once d has passed on this clock.
+	WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+// Timer is a single event created by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// WithClock makes the pipe and its stages use clock instead of the system time.
+func WithClock[R any](clock Clock) Option[R] {
+	return func(p *Pipe[R]) {
+		p.clock = clock
+	}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
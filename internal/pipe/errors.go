@@ -0,0 +1,137 @@
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const maxCollectedErrors = 100
+
+// StageError is an error returned by the function of a stage.
+type StageError struct {
+	Stage    string
+	Attempts int
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a panic recovered from a stage worker.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// protect calls fn and turns a panic in it into a *PanicError, so a bad record can't crash the process.
+func protect(fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Value: v,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+
+	return fn()
+}
+
+// Errors summarises what went wrong in a pipe. It's returned by Sink.
+type Errors struct {
+	// Fatal is the error which stopped the pipe, if any.
+	Fatal error
+	// Skipped are the errors of stages which skip failed records, up to maxCollectedErrors.
+	Skipped []*StageError
+	// TotalSkipped counts all skipped errors, including the ones not kept in Skipped.
+	TotalSkipped int
+}
+
+func (e *Errors) Error() string {
+	parts := []string{}
+	if e.Fatal != nil {
+		parts = append(parts, e.Fatal.Error())
+	}
+
+	if e.TotalSkipped > 0 {
+		countByStage := map[string]int{}
+		stages := []string{}
+		for _, err := range e.Skipped {
+			if countByStage[err.Stage] == 0 {
+				stages = append(stages, err.Stage)
+			}
+			countByStage[err.Stage]++
+		}
+
+		summaries := make([]string, 0, len(stages))
+		for _, stage := range stages {
+			summaries = append(summaries, fmt.Sprintf("%s: %d", stage, countByStage[stage]))
+		}
+		parts = append(parts, fmt.Sprintf("%d skipped errors (%s)", e.TotalSkipped, strings.Join(summaries, ", ")))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+func (e *Errors) Unwrap() []error {
+	errs := make([]error, 0, len(e.Skipped)+1)
+	if e.Fatal != nil {
+		errs = append(errs, e.Fatal)
+	}
+
+	for _, err := range e.Skipped {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// errorCollector keeps the errors skipped by stages.
+type errorCollector struct {
+	mu      sync.Mutex
+	skipped []*StageError
+	total   int
+}
+
+func (c *errorCollector) add(err *StageError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total++
+	if len(c.skipped) < maxCollectedErrors {
+		c.skipped = append(c.skipped, err)
+	}
+}
+
+func (c *errorCollector) summary(fatal error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if fatal == nil && c.total == 0 {
+		return nil
+	}
+
+	return &Errors{
+		Fatal:        fatal,
+		Skipped:      c.skipped,
+		TotalSkipped: c.total,
+	}
+}
+
+// IsSkipped reports whether err only contains errors which were skipped.
+func IsSkipped(err error) bool {
+	var errs *Errors
+	return errors.As(err, &errs) && errs.Fatal == nil
+}
@@ -0,0 +1,157 @@
+package pipe
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultMergeWindow     = time.Second
+	defaultMaxPendingMerge = 100
+)
+
+// mergeStage holds records back for a while so records sharing a key can be combined into one.
+type mergeStage[R any] struct {
+	stageBase
+	key        func(*R) string
+	merge      func(ctx context.Context, kept, r *R) *R
+	window     time.Duration
+	maxPending int
+}
+
+type MergeStageOption[R any] interface {
+	applyMerge(s *mergeStage[R])
+}
+
+type mergeStageOption[R any] func(s *mergeStage[R])
+
+func (o mergeStageOption[R]) applyMerge(s *mergeStage[R]) { o(s) }
+
+// MergeWindow sets how long a record is held back, from its arrival, waiting for records with the same key.
+func MergeWindow[R any](window time.Duration) MergeStageOption[R] {
+	return mergeStageOption[R](func(s *mergeStage[R]) {
+		s.window = window
+	})
+}
+
+// MaxPending sets how many records can be held back at once. The oldest one is forwarded when it's exceeded.
+func MaxPending[R any](maxPending int) MergeStageOption[R] {
+	return mergeStageOption[R](func(s *mergeStage[R]) {
+		s.maxPending = maxPending
+	})
+}
+
+type pendingRecord[R any] struct {
+	record   *R
+	deadline time.Time
+}
+
+func (s *mergeStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
+	defer close(outCh)
+	defer s.track()()
+
+	pending := map[string]*pendingRecord[R]{}
+	// keys of pending records in arrival order, so the oldest one always has the earliest deadline
+	var order []string
+	// keys already forwarded, their late duplicates are dropped
+	forwarded := map[string]struct{}{}
+
+	forwardOldest := func() bool {
+		key := order[0]
+		order = order[1:]
+		r := pending[key].record
+		delete(pending, key)
+		forwarded[key] = struct{}{}
+
+		select {
+		case outCh <- r:
+			s.observer.RecordsOut(s.name, 1)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var timer Timer
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	defer stopTimer()
+
+	for {
+		stopTimer()
+		s.observer.QueueDepth(s.name, len(pending))
+
+		var deadlineCh <-chan time.Time
+		if len(order) > 0 {
+			wait := pending[order[0]].deadline.Sub(s.clock.Now())
+			if wait <= 0 {
+				if !forwardOldest() {
+					return
+				}
+				continue
+			}
+
+			timer = s.clock.NewTimer(wait)
+			deadlineCh = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadlineCh:
+			if !forwardOldest() {
+				return
+			}
+		case r, ok := <-inCh:
+			if !ok {
+				// inCh is closed
+				for len(order) > 0 {
+					if !forwardOldest() {
+						return
+					}
+				}
+				return
+			}
+
+			s.observer.RecordIn(s.name)
+			key := s.key(r)
+			if key == "" {
+				// records without a key can't be merged
+				select {
+				case outCh <- r:
+					s.observer.RecordsOut(s.name, 1)
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			if _, ok := forwarded[key]; ok {
+				s.observer.RecordDropped(s.name)
+				continue
+			}
+
+			if p, ok := pending[key]; ok {
+				p.record = s.merge(ctx, p.record, r)
+				s.observer.RecordDropped(s.name)
+				continue
+			}
+
+			pending[key] = &pendingRecord[R]{
+				record:   r,
+				deadline: s.clock.Now().Add(s.window),
+			}
+			order = append(order, key)
+			if len(order) > s.maxPending && !forwardOldest() {
+				return
+			}
+		}
+	}
+}
+
+func (s *mergeStage[R]) getBufSize() int {
+	return 0
+}
@@ -0,0 +1,91 @@
+package pipe
+
+import "time"
+
+// Observer is notified about what happens in every stage of a pipe.
+// Methods are called concurrently from the stage workers so implementations must be thread-safe.
+type Observer interface {
+	// StageStarted is called when the stage starts processing.
+	StageStarted(stage string)
+	// StageFinished is called when the stage has closed its output.
+	StageFinished(stage string, elapsed time.Duration)
+	// RecordIn is called for every record received by the stage.
+	RecordIn(stage string)
+	// RecordsOut is called when the stage sends records downstream.
+	RecordsOut(stage string, n int)
+	// RecordDropped is called when the stage drops a record without any error.
+	RecordDropped(stage string)
+	// Error is called for every error returned by the stage function.
+	Error(stage string, err error)
+	// Processed is called with the time the stage function took for a record or a batch.
+	Processed(stage string, elapsed time.Duration)
+	// QueueDepth is called with the number of records waiting in the stage.
+	QueueDepth(stage string, depth int)
+}
+
+// NopObserver ignores everything. It can be embedded to implement only some methods of Observer.
+type NopObserver struct{}
+
+func (NopObserver) StageStarted(string)                 {}
+func (NopObserver) StageFinished(string, time.Duration) {}
+func (NopObserver) RecordIn(string)                     {}
+func (NopObserver) RecordsOut(string, int)              {}
+func (NopObserver) RecordDropped(string)                {}
+func (NopObserver) Error(string, error)                 {}
+func (NopObserver) Processed(string, time.Duration)     {}
+func (NopObserver) QueueDepth(string, int)              {}
+
+type multiObserver []Observer
+
+// MultiObserver notifies all observers.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+func (m multiObserver) StageStarted(stage string) {
+	for _, o := range m {
+		o.StageStarted(stage)
+	}
+}
+
+func (m multiObserver) StageFinished(stage string, elapsed time.Duration) {
+	for _, o := range m {
+		o.StageFinished(stage, elapsed)
+	}
+}
+
+func (m multiObserver) RecordIn(stage string) {
+	for _, o := range m {
+		o.RecordIn(stage)
+	}
+}
+
+func (m multiObserver) RecordsOut(stage string, n int) {
+	for _, o := range m {
+		o.RecordsOut(stage, n)
+	}
+}
+
+func (m multiObserver) RecordDropped(stage string) {
+	for _, o := range m {
+		o.RecordDropped(stage)
+	}
+}
+
+func (m multiObserver) Error(stage string, err error) {
+	for _, o := range m {
+		o.Error(stage, err)
+	}
+}
+
+func (m multiObserver) Processed(stage string, elapsed time.Duration) {
+	for _, o := range m {
+		o.Processed(stage, elapsed)
+	}
+}
+
+func (m multiObserver) QueueDepth(stage string, depth int) {
+	for _, o := range m {
+		o.QueueDepth(stage, depth)
+	}
+}
@@ -0,0 +1,90 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/stretchr/testify/require"
+)
+
+// countingObserver counts the events of every stage by name.
+type countingObserver struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+func newCountingObserver() *countingObserver {
+	return &countingObserver{counts: map[string]map[string]int{}}
+}
+
+func (o *countingObserver) add(stage, event string, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.counts[stage] == nil {
+		o.counts[stage] = map[string]int{}
+	}
+	o.counts[stage][event] += n
+}
+
+func (o *countingObserver) StageStarted(stage string)                   { o.add(stage, "started", 1) }
+func (o *countingObserver) StageFinished(stage string, _ time.Duration) { o.add(stage, "finished", 1) }
+func (o *countingObserver) RecordIn(stage string)                       { o.add(stage, "in", 1) }
+func (o *countingObserver) RecordsOut(stage string, n int)              { o.add(stage, "out", n) }
+func (o *countingObserver) RecordDropped(stage string)                  { o.add(stage, "dropped", 1) }
+func (o *countingObserver) Error(stage string, _ error)                 { o.add(stage, "error", 1) }
+func (o *countingObserver) Processed(stage string, _ time.Duration)     { o.add(stage, "processed", 1) }
+func (o *countingObserver) QueueDepth(string, int)                      {}
+
+func TestObserver(t *testing.T) {
+	observer := newCountingObserver()
+	p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5, 6), pipe.WithObserver[record](observer))
+	p.Map(func(_ context.Context, r *record) (*record, error) {
+		if r.value == 2 {
+			return nil, errors.New("bad record")
+		}
+		return r, nil
+	}, pipe.Name[record]("fail"), pipe.SkipOnError[record]())
+	p.Filter(func(_ context.Context, r *record) bool {
+		return r.value%2 == 1
+	}, pipe.Name[record]("odd"))
+
+	count := 0
+	err := p.Sink(func(_ *record) error {
+		count++
+		return nil
+	})
+	require.True(t, pipe.IsSkipped(err))
+	require.Equal(t, 3, count)
+
+	// stages may still be finishing after Sink returns
+	require.Eventually(t, func() bool {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		return observer.counts["fail"]["finished"] == 1 && observer.counts["odd"]["finished"] == 1
+	}, time.Second, time.Millisecond)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	require.Equal(t, map[string]int{
+		"started":   1,
+		"finished":  1,
+		"in":        6,
+		"out":       5,
+		"dropped":   1,
+		"error":     1,
+		"processed": 6,
+	}, observer.counts["fail"])
+	require.Equal(t, map[string]int{
+		"started":   1,
+		"finished":  1,
+		"in":        5,
+		"out":       3,
+		"dropped":   2,
+		"processed": 5,
+	}, observer.counts["odd"])
+}
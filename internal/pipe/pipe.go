@@ -1,59 +1,104 @@
 package pipe
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 const (
 	defaultConcurrency = 5
-	pipeTimeout        = 20 * time.Second
+	defaultTimeout     = 20 * time.Second
 )
 
 type Pipe[R any] struct {
-	source    Source[R]
-	stages    []pipeStage[R]
-	stopped   chan struct{}
-	errCh     chan error
-	timeoutCh <-chan time.Time
+	source   Source[R]
+	stages   []pipeStage[R]
+	ctx      context.Context
+	cancel   context.CancelFunc
+	errCh    chan error
+	observer Observer
+	clock    Clock
+	timeout  time.Duration
+	skipped  *errorCollector
 }
 
-type Source[R any] func() ([]*R, error)
+type Option[R any] func(p *Pipe[R])
+
+type Source[R any] func(ctx context.Context) ([]*R, error)
 type Sink[R any] func(*R) error
 
 type pipeStage[R any] interface {
-	process(inCh <-chan *R, outCh chan<- *R)
+	process(ctx context.Context, inCh <-chan *R, outCh chan<- *R)
 	getBufSize() int
+	getBase() *stageBase
 }
 
-func New[R any](source Source[R]) *Pipe[R] {
+// stageHost is what a stage needs from the pipe it belongs to.
+type stageHost interface {
+	getObserver() Observer
+	getClock() Clock
+	reportError(err error)
+	skipError(err *StageError)
+}
 
-	return &Pipe[R]{
-		source:    source,
-		errCh:     make(chan error, 1),
-		stopped:   make(chan struct{}),
-		timeoutCh: time.After(pipeTimeout),
+// WithObserver reports what happens in every stage of the pipe to observer.
+func WithObserver[R any](observer Observer) Option[R] {
+	return func(p *Pipe[R]) {
+		p.observer = observer
 	}
 }
 
-func (p *Pipe[R]) Map(fn func(r *R) (*R, error), opts ...SimpleStageOption[R]) {
-	p.FanOut(func(in *R) ([]*R, error) {
-		out, err := fn(in)
+// WithTimeout stops the pipe after d instead of the default 20 seconds.
+func WithTimeout[R any](d time.Duration) Option[R] {
+	return func(p *Pipe[R]) {
+		p.timeout = d
+	}
+}
+
+// New creates a pipe bound to ctx. The pipe is stopped when ctx is done or after its timeout,
+// and stage functions receive a context which is cancelled at the same time.
+func New[R any](ctx context.Context, source Source[R], opts ...Option[R]) *Pipe[R] {
+	p := &Pipe[R]{
+		source:   source,
+		errCh:    make(chan error, 1),
+		observer: NopObserver{},
+		clock:    realClock{},
+		timeout:  defaultTimeout,
+		skipped:  &errorCollector{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.ctx, p.cancel = p.clock.WithTimeout(ctx, p.timeout)
+	return p
+}
+
+func (p *Pipe[R]) Map(fn func(ctx context.Context, r *R) (*R, error), opts ...SimpleStageOption[R]) {
+	p.addSimpleStage("map", func(ctx context.Context, in *R) ([]*R, error) {
+		out, err := fn(ctx, in)
 		if err != nil {
 			return nil, err
 		}
 
 		return []*R{out}, nil
-	}, opts...)
+	}, opts)
 }
 
-func (p *Pipe[R]) FanOut(fn func(r *R) ([]*R, error), opts ...SimpleStageOption[R]) {
+func (p *Pipe[R]) FanOut(fn func(ctx context.Context, r *R) ([]*R, error), opts ...SimpleStageOption[R]) {
+	p.addSimpleStage("fanout", fn, opts)
+}
+
+func (p *Pipe[R]) addSimpleStage(kind string, fn func(ctx context.Context, r *R) ([]*R, error), opts []SimpleStageOption[R]) {
 	stage := &simpleStage[R]{
+		stageBase:   stageBase{kind: kind},
 		fn:          fn,
 		concurrency: defaultConcurrency,
-		reportError: p.reportError,
-		stopped:     p.stopped,
 	}
 
 	for _, opt := range opts {
-		opt(stage)
+		opt.applySimple(stage)
 	}
 
 	p.stages = append(p.stages, stage)
@@ -64,57 +109,53 @@ func (p *Pipe[R]) Sink(sink Sink[R]) error {
 	go p.startSource(outCh)
 
 	for i, stage := range p.stages {
+		stage.getBase().init(i, p)
 		inCh := outCh
 		outCh = make(chan *R, p.getBufSize(i+1))
-		go stage.process(inCh, outCh)
+		go p.runStage(stage, inCh, outCh)
 	}
 
-	p.startSink(sink, outCh)
-	select {
-	case <-p.timeoutCh:
-		p.Stop()
-	case <-p.stopped:
-	}
+	<-p.startSink(sink, outCh)
+	p.Stop()
 
 	select {
 	case err := <-p.errCh:
-		return err
+		return p.skipped.summary(err)
 	default:
-		return nil
+		return p.skipped.summary(nil)
 	}
 }
 
-func (p *Pipe[R]) Channel(fn func(r *R, stopCh <-chan struct{}, outCh chan<- *R) error) {
+func (p *Pipe[R]) Channel(fn func(ctx context.Context, r *R, outCh chan<- *R) error, opts ...ChannelStageOption[R]) {
 	stage := &channelStage[R]{
+		stageBase:   stageBase{kind: "channel"},
 		fn:          fn,
 		concurrency: defaultChannelConcurrency,
-		reportError: p.reportError,
-		stopped:     p.stopped,
+	}
+
+	for _, opt := range opts {
+		opt.applyChannel(stage)
 	}
 
 	p.stages = append(p.stages, stage)
 }
 
 func (p *Pipe[R]) Stop() {
-	select {
-	case <-p.stopped:
-	default:
-		close(p.stopped)
-	}
+	p.cancel()
 }
 
-func (p *Pipe[R]) Batch(fn func([]*R) ([]*R, error), opts ...BatchStageOption[R]) {
+func (p *Pipe[R]) Batch(fn func(ctx context.Context, r []*R) ([]*R, error), opts ...BatchStageOption[R]) {
 	stage := &batchStage[R]{
-		fn:          fn,
-		workerSize:  defaultWorkerSize,
-		batchSize:   defaultBatchSize,
-		reportError: p.reportError,
-		stoped:      p.stopped,
-		batchCh:     make(chan []*R),
+		stageBase:  stageBase{kind: "batch"},
+		fn:         fn,
+		workerSize: defaultWorkerSize,
+		batchSize:  defaultBatchSize,
+		minSize:    defaultMinSize,
+		batchCh:    make(chan []*R),
 	}
 
 	for _, opt := range opts {
-		opt(stage)
+		opt.applyBatch(stage)
 	}
 
 	p.stages = append(p.stages, stage)
@@ -122,7 +163,7 @@ func (p *Pipe[R]) Batch(fn func([]*R) ([]*R, error), opts ...BatchStageOption[R]
 
 func (p *Pipe[R]) Shuffle(higher func(*R, *R) bool, opts ...ShuffleStageOption[R]) {
 	stage := &shuffleStage[R]{
-		stopped: p.stopped,
+		stageBase: stageBase{kind: "shuffle"},
 		queue: &priorityQueue[R]{
 			data:   make([]*R, 0, defaultShuffleSize),
 			higher: higher,
@@ -131,53 +172,126 @@ func (p *Pipe[R]) Shuffle(higher func(*R, *R) bool, opts ...ShuffleStageOption[R
 	}
 
 	for _, opt := range opts {
-		opt(stage)
+		opt.applyShuffle(stage)
 	}
 
 	p.stages = append(p.stages, stage)
 }
 
-func (p *Pipe[R]) Filter(fn func(r *R) bool, opts ...SimpleStageOption[R]) {
-	p.FanOut(func(in *R) ([]*R, error) {
-		ok := fn(in)
+// Take stops the pipe early once n records have been forwarded downstream.
+func (p *Pipe[R]) Take(n int, opts ...TakeStageOption[R]) {
+	stage := &takeStage[R]{
+		stageBase: stageBase{kind: "take"},
+		n:         n,
+		stop:      p.Stop,
+	}
+
+	for _, opt := range opts {
+		opt.applyTake(stage)
+	}
+
+	p.stages = append(p.stages, stage)
+}
+
+// Merge combines records sharing the key returned by key using merge, which receives the record held so far
+// and the new one and returns the combined record. A record is forwarded once MergeWindow has passed since
+// its arrival, and later records with the same key are dropped. Records with an empty key are forwarded as-is.
+func (p *Pipe[R]) Merge(key func(*R) string, merge func(ctx context.Context, kept, r *R) *R, opts ...MergeStageOption[R]) {
+	stage := &mergeStage[R]{
+		stageBase:  stageBase{kind: "merge"},
+		key:        key,
+		merge:      merge,
+		window:     defaultMergeWindow,
+		maxPending: defaultMaxPendingMerge,
+	}
+
+	for _, opt := range opts {
+		opt.applyMerge(stage)
+	}
+
+	p.stages = append(p.stages, stage)
+}
+
+func (p *Pipe[R]) Filter(fn func(ctx context.Context, r *R) bool, opts ...SimpleStageOption[R]) {
+	p.addSimpleStage("filter", func(ctx context.Context, in *R) ([]*R, error) {
+		ok := fn(ctx, in)
 		if ok {
 			return []*R{in}, nil
 		}
 
 		return nil, nil
-	}, opts...)
+	}, opts)
 }
 
 func (p *Pipe[R]) Stage(stage pipeStage[R]) {
 	p.stages = append(p.stages, stage)
 }
 
+// runStage runs a stage and stops the pipe if it panics outside of its stage function,
+// e.g. in the comparator of a Shuffle stage.
+func (p *Pipe[R]) runStage(stage pipeStage[R], inCh <-chan *R, outCh chan<- *R) {
+	stage.getBase().guard(func() {
+		stage.process(p.ctx, inCh, outCh)
+	})
+}
+
 func (p *Pipe[R]) startSource(outCh chan<- *R) {
 	defer close(outCh)
-	records, err := p.source()
+	var records []*R
+	err := protect(func() (err error) {
+		records, err = p.source(p.ctx)
+		return err
+	})
 	if err != nil {
 		p.reportError(err)
 		return
 	}
 
-	SendRecords(records, outCh, p.stopped)
+	SendRecords(p.ctx, records, outCh)
 }
 
-func (p *Pipe[R]) startSink(sink Sink[R], inCh <-chan *R) {
+// startSink consumes records until the last stage is drained or the pipe is stopped.
+// The returned channel is closed once the sink won't be called anymore.
+func (p *Pipe[R]) startSink(sink Sink[R], inCh <-chan *R) <-chan struct{} {
+	done := make(chan struct{})
 	go func() {
-		for record := range inCh {
-			err := sink(record)
-			if err != nil {
-				p.reportError(err)
+		defer close(done)
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case record, ok := <-inCh:
+				if !ok {
+					return
+				}
+
+				err := protect(func() error {
+					return sink(record)
+				})
+				if err != nil {
+					p.reportError(err)
+				}
 			}
 		}
-		p.Stop()
 	}()
+	return done
+}
+
+func (p *Pipe[R]) getObserver() Observer {
+	return p.observer
+}
+
+func (p *Pipe[R]) getClock() Clock {
+	return p.clock
+}
+
+func (p *Pipe[R]) skipError(err *StageError) {
+	p.skipped.add(err)
 }
 
 func (p *Pipe[R]) reportError(err error) {
 	select {
-	case <-p.stopped:
+	case <-p.ctx.Done():
 	case p.errCh <- err:
 		p.Stop()
 	default:
@@ -0,0 +1,255 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type record struct {
+	value int
+}
+
+func sourceOf(values ...int) pipe.Source[record] {
+	return func(_ context.Context) ([]*record, error) {
+		records := make([]*record, 0, len(values))
+		for _, v := range values {
+			records = append(records, &record{value: v})
+		}
+		return records, nil
+	}
+}
+
+func panicOn(bad int) func(ctx context.Context, r *record) (*record, error) {
+	return func(_ context.Context, r *record) (*record, error) {
+		if r.value == bad {
+			panic("bad record")
+		}
+		return r, nil
+	}
+}
+
+func TestPipe_Panic(t *testing.T) {
+	t.Run("should fail the pipe when a stage panics", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3))
+		p.Map(panicOn(2), pipe.Name[record]("boom"))
+
+		err := p.Sink(func(_ *record) error { return nil })
+		require.Error(t, err)
+
+		var stageErr *pipe.StageError
+		require.ErrorAs(t, err, &stageErr)
+		require.Equal(t, "boom", stageErr.Stage)
+
+		var panicErr *pipe.PanicError
+		require.ErrorAs(t, err, &panicErr)
+		require.Equal(t, "bad record", panicErr.Value)
+		require.Contains(t, string(panicErr.Stack), "pipe_test.go")
+	})
+
+	t.Run("should skip the record when the stage skips errors", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3))
+		p.Map(panicOn(2), pipe.SkipOnError[record]())
+
+		var got []int
+		err := p.Sink(func(r *record) error {
+			got = append(got, r.value)
+			return nil
+		})
+		require.True(t, pipe.IsSkipped(err))
+		require.ElementsMatch(t, []int{1, 3}, got)
+	})
+
+	t.Run("should recover panics outside of stage functions", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3))
+		p.Shuffle(func(_, _ *record) bool { panic("bad comparator") })
+
+		err := p.Sink(func(_ *record) error { return nil })
+		var panicErr *pipe.PanicError
+		require.ErrorAs(t, err, &panicErr)
+	})
+
+	t.Run("should recover panics of observers in any goroutine of a stage", func(t *testing.T) {
+		batch := func(p *pipe.Pipe[record]) {
+			p.Batch(func(_ context.Context, batch []*record) ([]*record, error) {
+				return batch, nil
+			}, pipe.Name[record]("stage"))
+		}
+
+		for name, tc := range map[string]struct {
+			addStage func(p *pipe.Pipe[record])
+			event    string
+		}{
+			"map worker": {
+				addStage: func(p *pipe.Pipe[record]) { p.Map(identity, pipe.Name[record]("stage")) },
+				event:    "in",
+			},
+			"channel forwarder": {
+				addStage: func(p *pipe.Pipe[record]) {
+					p.Channel(func(ctx context.Context, r *record, outCh chan<- *record) error {
+						pipe.SendRecords(ctx, []*record{r}, outCh)
+						return nil
+					}, pipe.Name[record]("stage"))
+				},
+				event: "out",
+			},
+			"batch flusher": {addStage: batch, event: "in"},
+			"batch worker":  {addStage: batch, event: "out"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				observer := panickingObserver{stage: "stage", event: tc.event}
+				p := pipe.New(context.Background(), sourceOf(1, 2, 3), pipe.WithObserver[record](observer))
+				tc.addStage(p)
+
+				err := p.Sink(func(_ *record) error { return nil })
+				var panicErr *pipe.PanicError
+				require.ErrorAs(t, err, &panicErr)
+				require.Equal(t, "observer of stage", panicErr.Value)
+			})
+		}
+	})
+
+	t.Run("should fail one request without taking the server down", func(t *testing.T) {
+		app := fiber.New()
+		app.Get("/:value", func(c *fiber.Ctx) error {
+			value, err := c.ParamsInt("value")
+			if err != nil {
+				return fiber.ErrBadRequest
+			}
+
+			p := pipe.New(c.UserContext(), sourceOf(value))
+			p.Map(panicOn(2))
+			if err := p.Sink(func(_ *record) error { return nil }); err != nil {
+				return errors.New("pipeline failed")
+			}
+
+			return c.SendStatus(fiber.StatusOK)
+		})
+
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/2", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		resp, err = app.Test(httptest.NewRequest(fiber.MethodGet, "/1", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestPipe_Batch(t *testing.T) {
+	t.Run("should split records into batches of BatchSize", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5, 6, 7))
+		var mu sync.Mutex
+		var sizes []int
+		p.Batch(func(_ context.Context, batch []*record) ([]*record, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			sizes = append(sizes, len(batch))
+			return batch, nil
+		}, pipe.BatchSize[record](3), pipe.MinSize[record](3))
+
+		count := 0
+		err := p.Sink(func(_ *record) error {
+			count++
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 7, count)
+		require.ElementsMatch(t, []int{3, 3, 1}, sizes)
+	})
+
+}
+
+func TestPipe_Merge(t *testing.T) {
+	byParity := func(r *record) string {
+		if r.value%2 == 0 {
+			return "even"
+		}
+		return "odd"
+	}
+	sum := func(_ context.Context, kept, r *record) *record {
+		kept.value += r.value
+		return kept
+	}
+
+	t.Run("should merge records sharing a key", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5))
+		p.Merge(byParity, sum, pipe.MergeWindow[record](time.Second))
+
+		var got []int
+		err := p.Sink(func(r *record) error {
+			got = append(got, r.value)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{9, 6}, got)
+	})
+
+	t.Run("should forward the oldest record when too many are pending", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4))
+		p.Merge(func(r *record) string { return strconv.Itoa(r.value % 3) }, sum, pipe.MaxPending[record](2))
+
+		var got []int
+		err := p.Sink(func(r *record) error {
+			got = append(got, r.value)
+			return nil
+		})
+		require.NoError(t, err)
+		// 1 is forwarded when 3 arrives, so 4 is dropped as a late duplicate
+		require.Equal(t, []int{1, 2, 3}, got)
+	})
+}
+
+func TestTopK(t *testing.T) {
+	higherFirst := func(a, b *record) int {
+		return b.value - a.value
+	}
+
+	t.Run("should keep the best records in order", func(t *testing.T) {
+		p := pipe.New(context.Background(), sourceOf(4, 9, 1, 7, 3, 8, 2))
+		top := pipe.NewTopK(3, higherFirst)
+		require.NoError(t, p.Sink(top.Sink))
+
+		got := make([]int, 0, 3)
+		for _, r := range top.Results() {
+			got = append(got, r.value)
+		}
+		require.Equal(t, []int{9, 8, 7}, got)
+	})
+
+	t.Run("should return fewer records than n", func(t *testing.T) {
+		top := pipe.NewTopK(3, higherFirst)
+		require.NoError(t, top.Sink(&record{value: 1}))
+		require.NoError(t, top.Sink(&record{value: 2}))
+		require.Len(t, top.Results(), 2)
+		require.Equal(t, 2, top.Results()[0].value)
+	})
+}
+
+// panickingObserver panics when records of the stage go in or out.
+type panickingObserver struct {
+	pipe.NopObserver
+	stage string
+	event string
+}
+
+func (o panickingObserver) RecordIn(stage string) {
+	if stage == o.stage && o.event == "in" {
+		panic("observer of " + stage)
+	}
+}
+
+func (o panickingObserver) RecordsOut(stage string, _ int) {
+	if stage == o.stage && o.event == "out" {
+		panic("observer of " + stage)
+	}
+}
@@ -0,0 +1,119 @@
+package pipeotel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ pipe.Observer = (*Observer)(nil)
+
+// Observer records a span per stage of a pipe, with the stage stats as attributes.
+// A new Observer should be created for every pipe.
+type Observer struct {
+	ctx    context.Context
+	tracer trace.Tracer
+
+	mu     sync.Mutex
+	stages map[string]*stageSpan
+}
+
+type stageSpan struct {
+	span          trace.Span
+	recordsIn     int
+	recordsOut    int
+	dropped       int
+	errors        int
+	processing    time.Duration
+	maxQueueDepth int
+}
+
+// New creates an Observer whose spans are children of the span in ctx.
+func New(ctx context.Context, tracer trace.Tracer) *Observer {
+	return &Observer{
+		ctx:    ctx,
+		tracer: tracer,
+		stages: map[string]*stageSpan{},
+	}
+}
+
+func (o *Observer) StageStarted(stage string) {
+	_, span := o.tracer.Start(o.ctx, "pipe.stage "+stage, trace.WithAttributes(
+		attribute.String("pipe.stage", stage),
+	))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stages[stage] = &stageSpan{span: span}
+}
+
+func (o *Observer) StageFinished(stage string, elapsed time.Duration) {
+	o.mu.Lock()
+	s, ok := o.stages[stage]
+	delete(o.stages, stage)
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.span.SetAttributes(
+		attribute.Int("pipe.records_in", s.recordsIn),
+		attribute.Int("pipe.records_out", s.recordsOut),
+		attribute.Int("pipe.records_dropped", s.dropped),
+		attribute.Int("pipe.errors", s.errors),
+		attribute.Int64("pipe.processing_ms", s.processing.Milliseconds()),
+		attribute.Int("pipe.max_queue_depth", s.maxQueueDepth),
+	)
+	s.span.End()
+}
+
+func (o *Observer) RecordIn(stage string) {
+	o.update(stage, func(s *stageSpan) {
+		s.recordsIn++
+	})
+}
+
+func (o *Observer) RecordsOut(stage string, n int) {
+	o.update(stage, func(s *stageSpan) {
+		s.recordsOut += n
+	})
+}
+
+func (o *Observer) RecordDropped(stage string) {
+	o.update(stage, func(s *stageSpan) {
+		s.dropped++
+	})
+}
+
+func (o *Observer) Error(stage string, err error) {
+	o.update(stage, func(s *stageSpan) {
+		s.errors++
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	})
+}
+
+func (o *Observer) Processed(stage string, elapsed time.Duration) {
+	o.update(stage, func(s *stageSpan) {
+		s.processing += elapsed
+	})
+}
+
+func (o *Observer) QueueDepth(stage string, depth int) {
+	o.update(stage, func(s *stageSpan) {
+		s.maxQueueDepth = max(s.maxQueueDepth, depth)
+	})
+}
+
+func (o *Observer) update(stage string, fn func(s *stageSpan)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s, ok := o.stages[stage]; ok {
+		fn(s)
+	}
+}
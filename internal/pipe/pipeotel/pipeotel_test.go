@@ -0,0 +1,61 @@
+package pipeotel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipeotel"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestObserver(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "request")
+	p := pipe.New(ctx, func(_ context.Context) ([]*int, error) {
+		values := []int{1, 2, 3}
+		return []*int{&values[0], &values[1], &values[2]}, nil
+	}, pipe.WithObserver[int](pipeotel.New(ctx, tracer)))
+	p.Map(func(_ context.Context, v *int) (*int, error) {
+		if *v == 2 {
+			return nil, errors.New("bad record")
+		}
+		return v, nil
+	}, pipe.Name[int]("check"), pipe.SkipOnError[int]())
+
+	require.True(t, pipe.IsSkipped(p.Sink(func(_ *int) error { return nil })))
+	parent.End()
+
+	var span sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		for _, ended := range recorder.Ended() {
+			if ended.Name() == "pipe.stage check" {
+				span = ended
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	require.Equal(t, codes.Error, span.Status().Code)
+	require.Len(t, span.Events(), 1)
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	require.Equal(t, "check", attrs["pipe.stage"].AsString())
+	require.EqualValues(t, 3, attrs["pipe.records_in"].AsInt64())
+	require.EqualValues(t, 2, attrs["pipe.records_out"].AsInt64())
+	require.EqualValues(t, 1, attrs["pipe.records_dropped"].AsInt64())
+	require.EqualValues(t, 1, attrs["pipe.errors"].AsInt64())
+}
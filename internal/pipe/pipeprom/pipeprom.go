@@ -0,0 +1,82 @@
+package pipeprom
+
+import (
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ pipe.Observer = (*Observer)(nil)
+
+// Observer exports the stats of pipe stages as Prometheus metrics.
+// It's safe to share one Observer between all pipes.
+type Observer struct {
+	records       *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	processing    *prometheus.HistogramVec
+	stageDuration *prometheus.HistogramVec
+	queueDepth    *prometheus.HistogramVec
+}
+
+// New creates an Observer and registers its metrics to reg.
+func New(reg prometheus.Registerer) *Observer {
+	o := &Observer{
+		records: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pipe_stage_records_total",
+			Help: "Records seen by pipe stages, by event (in, out or dropped).",
+		}, []string{"stage", "event"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pipe_stage_errors_total",
+			Help: "Errors returned by pipe stage functions.",
+		}, []string{"stage"}),
+		processing: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pipe_stage_processing_seconds",
+			Help:    "Time spent by pipe stage functions per record or batch.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"stage"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pipe_stage_duration_seconds",
+			Help:    "Time from the start of a pipe stage until its output is closed.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"stage"}),
+		queueDepth: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pipe_stage_queue_depth",
+			Help:    "Records waiting in a pipe stage.",
+			Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200},
+		}, []string{"stage"}),
+	}
+
+	reg.MustRegister(o.records, o.errors, o.processing, o.stageDuration, o.queueDepth)
+	return o
+}
+
+func (o *Observer) StageStarted(string) {}
+
+func (o *Observer) StageFinished(stage string, elapsed time.Duration) {
+	o.stageDuration.WithLabelValues(stage).Observe(elapsed.Seconds())
+}
+
+func (o *Observer) RecordIn(stage string) {
+	o.records.WithLabelValues(stage, "in").Inc()
+}
+
+func (o *Observer) RecordsOut(stage string, n int) {
+	o.records.WithLabelValues(stage, "out").Add(float64(n))
+}
+
+func (o *Observer) RecordDropped(stage string) {
+	o.records.WithLabelValues(stage, "dropped").Inc()
+}
+
+func (o *Observer) Error(stage string, _ error) {
+	o.errors.WithLabelValues(stage).Inc()
+}
+
+func (o *Observer) Processed(stage string, elapsed time.Duration) {
+	o.processing.WithLabelValues(stage).Observe(elapsed.Seconds())
+}
+
+func (o *Observer) QueueDepth(stage string, depth int) {
+	o.queueDepth.WithLabelValues(stage).Observe(float64(depth))
+}
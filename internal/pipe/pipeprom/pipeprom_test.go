@@ -0,0 +1,52 @@
+package pipeprom_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipeprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p := pipe.New(context.Background(), func(_ context.Context) ([]*int, error) {
+		values := []int{1, 2, 3}
+		return []*int{&values[0], &values[1], &values[2]}, nil
+	}, pipe.WithObserver[int](pipeprom.New(reg)))
+	p.Map(func(_ context.Context, v *int) (*int, error) {
+		if *v == 2 {
+			return nil, errors.New("bad record")
+		}
+		return v, nil
+	}, pipe.Name[int]("check"), pipe.SkipOnError[int]())
+
+	require.True(t, pipe.IsSkipped(p.Sink(func(_ *int) error { return nil })))
+
+	// the stage may still be finishing after Sink returns
+	require.Eventually(t, func() bool {
+		count, err := testutil.GatherAndCount(reg, "pipe_stage_duration_seconds")
+		return err == nil && count == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pipe_stage_errors_total Errors returned by pipe stage functions.
+# TYPE pipe_stage_errors_total counter
+pipe_stage_errors_total{stage="check"} 1
+# HELP pipe_stage_records_total Records seen by pipe stages, by event (in, out or dropped).
+# TYPE pipe_stage_records_total counter
+pipe_stage_records_total{event="dropped",stage="check"} 1
+pipe_stage_records_total{event="in",stage="check"} 3
+pipe_stage_records_total{event="out",stage="check"} 2
+`), "pipe_stage_errors_total", "pipe_stage_records_total"))
+
+	count, err := testutil.GatherAndCount(reg, "pipe_stage_processing_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
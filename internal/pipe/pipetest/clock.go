@@ -0,0 +1,152 @@
+// Package pipetest helps testing pipes deterministically.
+package pipetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+)
+
+var _ pipe.Clock = (*Clock)(nil)
+
+// Clock is a fake pipe.Clock. Time only moves when Advance is called.
+type Clock struct {
+	t      testing.TB
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	clock    *Clock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func NewClock(t testing.TB) *Clock {
+	c := &Clock{
+		t:   t,
+		now: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) pipe.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &timer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		ch:       make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+func (c *Clock) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	t := c.NewTimer(d)
+	go func() {
+		select {
+		case <-t.C():
+			cancel()
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// Advance moves the time forward and fires the timers which are due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+
+		t.ch <- c.now
+	}
+
+	c.timers = pending
+	c.cond.Broadcast()
+}
+
+// BlockUntil waits until n timers are waiting to fire, e.g. to make sure a stage has started waiting
+// before calling Advance. Note that every pipe has a timer for its timeout.
+func (c *Clock) BlockUntil(n int) {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waitCond(c.t, c.cond, func() bool {
+		return len(c.timers) >= n
+	}, fmt.Sprintf("%d timers", n))
+}
+
+// waitCond waits on cond, whose lock is held, until done returns true.
+// The test fails if it takes longer than waitTimeout in real time.
+func waitCond(t testing.TB, cond *sync.Cond, done func() bool, what string) {
+	t.Helper()
+	timedOut := false
+	timer := time.AfterFunc(waitTimeout, func() {
+		cond.L.Lock()
+		defer cond.L.Unlock()
+		timedOut = true
+		cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	for !done() {
+		if timedOut {
+			t.Fatalf("pipetest: timed out waiting for %s", what)
+		}
+		cond.Wait()
+	}
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,189 @@
+package pipetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+)
+
+const (
+	inputStage = "pipetest-input"
+	// waitTimeout guards the test against a stuck pipe. It's in real time.
+	waitTimeout = 5 * time.Second
+)
+
+// Harness runs a pipe fed and drained step by step by the test.
+// Records are fed with Send and come out one at a time with Next, the sink is blocked in between.
+type Harness[R any] struct {
+	t     testing.TB
+	Pipe  *pipe.Pipe[R]
+	Clock *Clock
+
+	in       chan *R
+	out      chan *R
+	done     chan error
+	quit     chan struct{}
+	closed   bool
+	observer *observer
+}
+
+// observer lets the harness wait for stages to reach a given point.
+type observer struct {
+	pipe.NopObserver
+	mu       sync.Mutex
+	cond     *sync.Cond
+	recordIn map[string]int
+	finished map[string]bool
+}
+
+// New creates a harness for a pipe using a fake clock. Stages are added to h.Pipe before calling Start.
+// The harness observes the pipe itself, so opts mustn't include pipe.WithObserver.
+func New[R any](t testing.TB, opts ...pipe.Option[R]) *Harness[R] {
+	h := &Harness[R]{
+		t:     t,
+		Clock: NewClock(t),
+		in:    make(chan *R),
+		out:   make(chan *R),
+		done:  make(chan error, 1),
+		quit:  make(chan struct{}),
+		observer: &observer{
+			recordIn: map[string]int{},
+			finished: map[string]bool{},
+		},
+	}
+	h.observer.cond = sync.NewCond(&h.observer.mu)
+
+	opts = append([]pipe.Option[R]{pipe.WithClock[R](h.Clock), pipe.WithObserver[R](h.observer)}, opts...)
+	// the source only triggers the input stage which forwards what's sent by the test
+	h.Pipe = pipe.New(context.Background(), func(_ context.Context) ([]*R, error) {
+		return []*R{new(R)}, nil
+	}, opts...)
+	h.Pipe.Channel(h.forward, pipe.Name[R](inputStage))
+
+	t.Cleanup(func() {
+		close(h.quit)
+		h.Pipe.Stop()
+	})
+	return h
+}
+
+func (h *Harness[R]) forward(ctx context.Context, _ *R, outCh chan<- *R) error {
+	for {
+		select {
+		case r, ok := <-h.in:
+			if !ok {
+				return nil
+			}
+
+			select {
+			case outCh <- r:
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Start runs the pipe in the background.
+func (h *Harness[R]) Start() {
+	go func() {
+		h.done <- h.Pipe.Sink(func(r *R) error {
+			select {
+			case h.out <- r:
+			case <-h.quit:
+			}
+			return nil
+		})
+	}()
+}
+
+// Send feeds r to the first stage.
+func (h *Harness[R]) Send(r *R) {
+	h.t.Helper()
+	select {
+	case h.in <- r:
+	case <-time.After(waitTimeout):
+		h.t.Fatal("pipetest: timed out sending a record")
+	}
+}
+
+// Close tells the pipe there are no more records, so it drains and finishes.
+func (h *Harness[R]) Close() {
+	if !h.closed {
+		h.closed = true
+		close(h.in)
+	}
+}
+
+// Next returns the next record reaching the sink.
+func (h *Harness[R]) Next() *R {
+	h.t.Helper()
+	select {
+	case r := <-h.out:
+		return r
+	case <-time.After(waitTimeout):
+		h.t.Fatal("pipetest: timed out waiting for a record")
+		return nil
+	}
+}
+
+// Wait returns what Sink returned once the pipe is finished. Records still reaching the sink are dropped.
+func (h *Harness[R]) Wait() error {
+	h.t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case err := <-h.done:
+			return err
+		case <-h.out:
+		case <-timeout:
+			h.t.Fatal("pipetest: timed out waiting for the pipe to finish")
+			return nil
+		}
+	}
+}
+
+// WaitRecordIn waits until the named stage has received n records.
+func (h *Harness[R]) WaitRecordIn(stage string, n int) {
+	h.t.Helper()
+	h.observer.waitFor(h.t, func() bool {
+		return h.observer.recordIn[stage] >= n
+	}, "records in "+stage)
+}
+
+// WaitFinished waits until the named stage has returned, e.g. after the pipe is stopped or drained.
+func (h *Harness[R]) WaitFinished(stage string) {
+	h.t.Helper()
+	h.observer.waitFor(h.t, func() bool {
+		return h.observer.finished[stage]
+	}, stage+" to finish")
+}
+
+func (o *observer) waitFor(t testing.TB, cond func() bool, what string) {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	waitCond(t, o.cond, cond, what)
+}
+
+func (o *observer) RecordIn(stage string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.recordIn[stage]++
+	o.cond.Broadcast()
+}
+
+func (o *observer) StageFinished(stage string, _ time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.finished[stage] = true
+	o.cond.Broadcast()
+}
@@ -2,37 +2,47 @@ package pipe
 
 import (
 	"container/heap"
+	"context"
 )
 
 const (
 	defaultShuffleSize = 200
 )
 
-type ShuffleStageOption[R any] func(s *shuffleStage[R])
+type ShuffleStageOption[R any] interface {
+	applyShuffle(s *shuffleStage[R])
+}
+
+type shuffleStageOption[R any] func(s *shuffleStage[R])
+
+func (o shuffleStageOption[R]) applyShuffle(s *shuffleStage[R]) { o(s) }
 
 type shuffleStage[R any] struct {
-	stopped <-chan struct{}
+	stageBase
 	queue   *priorityQueue[R]
 	bufSize int
 }
 
 func ShuffleBuffer[R any](size int) ShuffleStageOption[R] {
-	return func(s *shuffleStage[R]) {
+	return shuffleStageOption[R](func(s *shuffleStage[R]) {
 		s.bufSize = size
-	}
+	})
 }
 
-func (s *shuffleStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
+func (s *shuffleStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
 	defer close(outCh)
+	defer s.track()()
 
 	shouldDrain := false
 	for {
+		s.observer.QueueDepth(s.name, s.queue.Len())
 		if len(s.queue.data) == cap(s.queue.data) || (shouldDrain && s.queue.Len() > 0) {
 			peek := s.queue.Peek()
 			select {
 			case outCh <- peek:
 				heap.Pop(s.queue)
-			case <-s.stopped:
+				s.observer.RecordsOut(s.name, 1)
+			case <-ctx.Done():
 				return
 			}
 		} else if s.queue.Len() > 0 {
@@ -43,20 +53,23 @@ func (s *shuffleStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
 					shouldDrain = true
 					continue
 				}
+				s.observer.RecordIn(s.name)
 				heap.Push(s.queue, r)
 			default:
 				peek := s.queue.Peek()
 				select {
 				case outCh <- peek:
 					heap.Pop(s.queue)
+					s.observer.RecordsOut(s.name, 1)
 				case newR, ok := <-inCh:
 					if !ok {
 						// inCh is closed
 						shouldDrain = true
 						continue
 					}
+					s.observer.RecordIn(s.name)
 					heap.Push(s.queue, newR)
-				case <-s.stopped:
+				case <-ctx.Done():
 					return
 				}
 			}
@@ -68,8 +81,9 @@ func (s *shuffleStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
 					// inCh is closed
 					return
 				}
+				s.observer.RecordIn(s.name)
 				heap.Push(s.queue, newR)
-			case <-s.stopped:
+			case <-ctx.Done():
 				return
 			}
 		}
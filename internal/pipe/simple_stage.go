@@ -1,40 +1,61 @@
 package pipe
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type simpleStage[R any] struct {
-	fn          func(r *R) ([]*R, error)
+	stageBase
+	fn          func(ctx context.Context, r *R) ([]*R, error)
 	concurrency int
-	reportError func(err error)
-	stopped     <-chan struct{}
 }
 
-type SimpleStageOption[R any] func(p *simpleStage[R])
+type SimpleStageOption[R any] interface {
+	applySimple(s *simpleStage[R])
+}
 
-func Concurrency[R any](concurrency int) SimpleStageOption[R] {
-	return func(p *simpleStage[R]) {
-		p.concurrency = concurrency
-	}
+type simpleStageOption[R any] func(s *simpleStage[R])
+
+func (o simpleStageOption[R]) applySimple(s *simpleStage[R]) { o(s) }
+
+// Concurrency sets the number of workers of a Map, FanOut, Filter or Channel stage.
+func Concurrency[R any](concurrency int) ConcurrencyOption[R] {
+	return ConcurrencyOption[R](concurrency)
 }
 
-func (s *simpleStage[R]) process(inCh <-chan *R, outCh chan<- *R) {
+// ConcurrencyOption can be passed to Map, FanOut, Filter and Channel stages.
+type ConcurrencyOption[R any] int
+
+func (o ConcurrencyOption[R]) applySimple(s *simpleStage[R])   { s.concurrency = int(o) }
+func (o ConcurrencyOption[R]) applyChannel(s *channelStage[R]) { s.concurrency = int(o) }
+
+func (s *simpleStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
 	defer close(outCh)
+	defer s.track()()
 
 	wg := &sync.WaitGroup{}
 	for i := 0; i < s.concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		s.spawn(wg, func() {
 			for r := range inCh {
-				outs, err := s.fn(r)
-				if err != nil {
-					s.reportError(err)
+				s.observer.RecordIn(s.name)
+				s.observer.QueueDepth(s.name, len(inCh))
+				var outs []*R
+				ok := s.call(ctx, func() (err error) {
+					outs, err = s.fn(ctx, r)
+					return err
+				})
+				if !ok {
 					return
-				} else {
-					SendRecords(outs, outCh, s.stopped)
 				}
+
+				if len(outs) == 0 {
+					s.observer.RecordDropped(s.name)
+				}
+				SendRecords(ctx, outs, outCh)
+				s.observer.RecordsOut(s.name, len(outs))
 			}
-		}()
+		})
 	}
 	wg.Wait()
 }
@@ -0,0 +1,161 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// stageBase holds what's common to all stages.
+type stageBase struct {
+	kind     string
+	name     string
+	observer Observer
+	clock    Clock
+
+	skipErrors   bool
+	retries      int
+	retryBackoff time.Duration
+	reportError  func(err error)
+	skipError    func(err *StageError)
+}
+
+// StageOption can be passed to any kind of stage.
+type StageOption[R any] func(b *stageBase)
+
+// Name names the stage when it's reported to the Observer of the pipe.
+func Name[R any](name string) StageOption[R] {
+	return func(b *stageBase) {
+		b.name = name
+	}
+}
+
+// SkipOnError drops the record (or batch) which failed and keeps the pipe running.
+// Skipped errors are summarised in the error returned by Sink.
+func SkipOnError[R any]() StageOption[R] {
+	return func(b *stageBase) {
+		b.skipErrors = true
+	}
+}
+
+// FailOnError stops the whole pipe on the first error. It's the default.
+func FailOnError[R any]() StageOption[R] {
+	return func(b *stageBase) {
+		b.skipErrors = false
+	}
+}
+
+// Retry calls the stage function again up to retries times when it fails, doubling backoff between attempts.
+// Note that records sent by a Channel stage before it failed are sent again.
+func Retry[R any](retries int, backoff time.Duration) StageOption[R] {
+	return func(b *stageBase) {
+		b.retries = retries
+		b.retryBackoff = backoff
+	}
+}
+
+func (o StageOption[R]) applySimple(s *simpleStage[R])   { o(&s.stageBase) }
+func (o StageOption[R]) applyChannel(s *channelStage[R]) { o(&s.stageBase) }
+func (o StageOption[R]) applyBatch(s *batchStage[R])     { o(&s.stageBase) }
+func (o StageOption[R]) applyShuffle(s *shuffleStage[R]) { o(&s.stageBase) }
+func (o StageOption[R]) applyTake(s *takeStage[R])       { o(&s.stageBase) }
+func (o StageOption[R]) applyMerge(s *mergeStage[R])     { o(&s.stageBase) }
+
+func (b *stageBase) getBase() *stageBase {
+	return b
+}
+
+func (b *stageBase) init(index int, p stageHost) {
+	if b.name == "" {
+		b.name = fmt.Sprintf("%s-%d", b.kind, index)
+	}
+
+	b.observer = p.getObserver()
+	b.clock = p.getClock()
+	b.reportError = p.reportError
+	b.skipError = p.skipError
+}
+
+// call runs fn with the error policy of the stage.
+// It returns false if fn failed and the stage must stop.
+func (b *stageBase) call(ctx context.Context, fn func() error) bool {
+	var err error
+	attempts := 0
+	backoff := b.retryBackoff
+	for {
+		attempts++
+		startedAt := b.clock.Now()
+		err = protect(fn)
+		b.observer.Processed(b.name, b.clock.Now().Sub(startedAt))
+		if err == nil {
+			return true
+		}
+
+		b.observer.Error(b.name, err)
+		if attempts > b.retries || ctx.Err() != nil {
+			break
+		}
+
+		timer := b.clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+			backoff *= 2
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+
+	// the pipe is stopping, errors of cancelled calls would only flood the summary
+	if ctx.Err() != nil {
+		return false
+	}
+
+	stageErr := &StageError{
+		Stage:    b.name,
+		Attempts: attempts,
+		Err:      err,
+	}
+
+	if b.skipErrors {
+		b.skipError(stageErr)
+		return true
+	}
+
+	b.reportError(stageErr)
+	return false
+}
+
+// guard calls fn and stops the pipe if it panics, e.g. in a callback of the observer.
+func (b *stageBase) guard(fn func()) {
+	err := protect(func() error {
+		fn()
+		return nil
+	})
+	if err != nil {
+		b.reportError(&StageError{
+			Stage:    b.name,
+			Attempts: 1,
+			Err:      err,
+		})
+	}
+}
+
+// spawn runs fn in a goroutine tracked by wg, guarded like the stage itself.
+func (b *stageBase) spawn(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.guard(fn)
+	}()
+}
+
+// track reports the lifetime of the stage. It should be deferred at the start of process.
+func (b *stageBase) track() func() {
+	startedAt := b.clock.Now()
+	b.observer.StageStarted(b.name)
+	return func() {
+		b.observer.StageFinished(b.name, b.clock.Now().Sub(startedAt))
+	}
+}
@@ -0,0 +1,384 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/pipe"
+	"github.com/bongnv/prowlarr-stremio/internal/pipe/pipetest"
+	"github.com/stretchr/testify/require"
+)
+
+func identity(_ context.Context, r *record) (*record, error) {
+	return r, nil
+}
+
+func TestStage_Stop(t *testing.T) {
+	t.Run("should stop a stage blocked sending downstream", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Map(identity, pipe.Name[record]("map"))
+		h.Start()
+
+		// the sink holds the first record and the stage blocks sending the second one
+		h.Send(&record{value: 1})
+		h.Send(&record{value: 2})
+		h.WaitRecordIn("map", 2)
+
+		h.Pipe.Stop()
+		h.WaitFinished("map")
+		require.NoError(t, h.Wait())
+	})
+
+	t.Run("should stop SendRecords when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		outCh := make(chan *record)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipe.SendRecords(ctx, []*record{{value: 1}, {value: 2}}, outCh)
+		}()
+
+		require.Equal(t, 1, (<-outCh).value)
+		cancel()
+		<-done
+	})
+
+	t.Run("should stop the pipe after its timeout", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Map(identity, pipe.Name[record]("map"))
+		h.Start()
+
+		h.Clock.BlockUntil(1)
+		h.Clock.Advance(time.Minute)
+		h.WaitFinished("map")
+		require.NoError(t, h.Wait())
+	})
+
+	t.Run("should stop the pipe after a custom timeout", func(t *testing.T) {
+		h := pipetest.New[record](t, pipe.WithTimeout[record](30*time.Second))
+		h.Pipe.Map(identity, pipe.Name[record]("map"))
+		h.Start()
+
+		h.Clock.BlockUntil(1)
+		h.Clock.Advance(29 * time.Second)
+		// the timer of the timeout is still pending
+		h.Clock.BlockUntil(1)
+		h.Send(&record{value: 1})
+		require.Equal(t, 1, h.Next().value)
+
+		h.Clock.Advance(time.Second)
+		h.WaitFinished("map")
+		require.NoError(t, h.Wait())
+	})
+}
+
+func TestStage_Drain(t *testing.T) {
+	h := pipetest.New[record](t)
+	h.Pipe.Map(identity, pipe.Name[record]("map"), pipe.Concurrency[record](1))
+	h.Pipe.Filter(func(_ context.Context, r *record) bool {
+		return r.value%2 == 1
+	}, pipe.Name[record]("odd"))
+	h.Start()
+
+	for i := 1; i <= 5; i++ {
+		h.Send(&record{value: i})
+	}
+	h.Close()
+
+	got := []int{h.Next().value, h.Next().value, h.Next().value}
+	require.ElementsMatch(t, []int{1, 3, 5}, got)
+
+	h.WaitFinished("map")
+	h.WaitFinished("odd")
+	require.NoError(t, h.Wait())
+}
+
+func TestStage_ShufflePriority(t *testing.T) {
+	h := pipetest.New[record](t)
+	h.Pipe.Shuffle(func(a, b *record) bool {
+		return a.value > b.value
+	}, pipe.Name[record]("shuffle"))
+	h.Start()
+
+	for i := 1; i <= 5; i++ {
+		h.Send(&record{value: i})
+	}
+	h.WaitRecordIn("shuffle", 5)
+	h.Close()
+
+	// the sink may already hold one record, the others are queued in the shuffle stage
+	got := make([]int, 0, 5)
+	for i := 0; i < 5; i++ {
+		got = append(got, h.Next().value)
+	}
+	require.ElementsMatch(t, []int{1, 2, 3, 4, 5}, got)
+	require.True(t, slices.IsSortedFunc(got[1:], func(a, b int) int { return b - a }), "got %v", got)
+	require.NoError(t, h.Wait())
+}
+
+func TestStage_BatchFlush(t *testing.T) {
+	var batches atomic.Int32
+	var lastSize atomic.Int32
+	h := pipetest.New[record](t)
+	h.Pipe.Batch(func(_ context.Context, batch []*record) ([]*record, error) {
+		batches.Add(1)
+		lastSize.Store(int32(len(batch)))
+		return batch, nil
+	},
+		pipe.Name[record]("batch"),
+		pipe.BatchSize[record](4),
+		pipe.MinSize[record](4),
+		pipe.MaxWait[record](time.Second),
+	)
+	h.Start()
+
+	t.Run("should flush a small batch after MaxWait", func(t *testing.T) {
+		h.Send(&record{value: 1})
+		h.Send(&record{value: 2})
+		h.WaitRecordIn("batch", 2)
+
+		// the pipe timeout and MaxWait
+		h.Clock.BlockUntil(2)
+		require.Zero(t, batches.Load())
+
+		h.Clock.Advance(time.Second)
+		require.ElementsMatch(t, []int{1, 2}, []int{h.Next().value, h.Next().value})
+		require.EqualValues(t, 1, batches.Load())
+		require.EqualValues(t, 2, lastSize.Load())
+	})
+
+	t.Run("should flush a full batch right away", func(t *testing.T) {
+		for i := 3; i <= 6; i++ {
+			h.Send(&record{value: i})
+		}
+
+		got := []int{h.Next().value, h.Next().value, h.Next().value, h.Next().value}
+		require.ElementsMatch(t, []int{3, 4, 5, 6}, got)
+		require.EqualValues(t, 2, batches.Load())
+		require.EqualValues(t, 4, lastSize.Load())
+	})
+
+	t.Run("should flush the rest on drain", func(t *testing.T) {
+		h.Send(&record{value: 7})
+		h.Close()
+
+		require.Equal(t, 7, h.Next().value)
+		require.NoError(t, h.Wait())
+		require.EqualValues(t, 1, lastSize.Load())
+	})
+}
+
+func TestStage_RetryBackoff(t *testing.T) {
+	var attempts atomic.Int32
+	h := pipetest.New[record](t)
+	h.Pipe.Map(func(_ context.Context, r *record) (*record, error) {
+		if attempts.Add(1) == 1 {
+			return nil, errors.New("try again")
+		}
+		return r, nil
+	}, pipe.Name[record]("map"), pipe.Retry[record](1, time.Second))
+	h.Start()
+
+	h.Send(&record{value: 1})
+	// the pipe timeout and the backoff
+	h.Clock.BlockUntil(2)
+	require.EqualValues(t, 1, attempts.Load())
+
+	h.Clock.Advance(time.Second)
+	require.Equal(t, 1, h.Next().value)
+	require.EqualValues(t, 2, attempts.Load())
+
+	h.Close()
+	require.NoError(t, h.Wait())
+}
+
+func TestStage_Take(t *testing.T) {
+	t.Run("should stop the pipe at n accepted records", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Take(2, pipe.Name[record]("take"))
+		h.Start()
+
+		h.Send(&record{value: 1})
+		require.Equal(t, 1, h.Next().value)
+		h.Send(&record{value: 2})
+		require.Equal(t, 2, h.Next().value)
+
+		// the pipe is stopped without closing the input
+		h.WaitFinished("take")
+		require.NoError(t, h.Wait())
+	})
+
+	t.Run("should forward but not count records rejected by TakeIf", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Take(2, pipe.Name[record]("take"), pipe.TakeIf(func(r *record) bool {
+			return r.value%2 == 0
+		}))
+		h.Start()
+
+		for i := 1; i <= 4; i++ {
+			h.Send(&record{value: i})
+			require.Equal(t, i, h.Next().value)
+		}
+
+		h.WaitFinished("take")
+		require.NoError(t, h.Wait())
+	})
+
+	t.Run("should stop at the soft deadline if a record was forwarded", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Take(10, pipe.Name[record]("take"), pipe.SoftDeadline[record](time.Second))
+		h.Start()
+
+		h.Send(&record{value: 1})
+		require.Equal(t, 1, h.Next().value)
+
+		// the pipe timeout and the soft deadline
+		h.Clock.BlockUntil(2)
+		h.Clock.Advance(time.Second)
+		h.WaitFinished("take")
+		require.NoError(t, h.Wait())
+	})
+
+	t.Run("should wait for a record after the soft deadline", func(t *testing.T) {
+		h := pipetest.New[record](t)
+		h.Pipe.Take(10, pipe.Name[record]("take"), pipe.SoftDeadline[record](time.Second))
+		h.Start()
+
+		h.Clock.BlockUntil(2)
+		h.Clock.Advance(time.Second)
+
+		// the pipe would be stopped and the record couldn't be sent if nothing was waited for
+		h.Send(&record{value: 1})
+		require.Equal(t, 1, h.Next().value)
+		h.WaitFinished("take")
+		require.NoError(t, h.Wait())
+	})
+}
+
+func TestStage_Errors(t *testing.T) {
+	failOn := func(calls *atomic.Int32, bad func(int) bool) func(context.Context, *record) (*record, error) {
+		return func(_ context.Context, r *record) (*record, error) {
+			calls.Add(1)
+			if bad(r.value) {
+				return nil, errors.New("bad record")
+			}
+			return r, nil
+		}
+	}
+	always := func(int) bool { return true }
+	even := func(v int) bool { return v%2 == 0 }
+
+	t.Run("should retry up to the given number of times", func(t *testing.T) {
+		var calls atomic.Int32
+		p := pipe.New(context.Background(), sourceOf(1))
+		p.Map(failOn(&calls, always), pipe.Name[record]("map"), pipe.Retry[record](2, 0))
+
+		err := p.Sink(func(_ *record) error { return nil })
+		var stageErr *pipe.StageError
+		require.ErrorAs(t, err, &stageErr)
+		require.Equal(t, "map", stageErr.Stage)
+		require.Equal(t, 3, stageErr.Attempts)
+		require.EqualValues(t, 3, calls.Load())
+	})
+
+	t.Run("should stop the pipe on the first error by default", func(t *testing.T) {
+		var calls atomic.Int32
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5))
+		p.Map(failOn(&calls, even), pipe.Concurrency[record](1))
+
+		var got []int
+		err := p.Sink(func(r *record) error {
+			got = append(got, r.value)
+			return nil
+		})
+		require.Error(t, err)
+		require.False(t, pipe.IsSkipped(err))
+		require.Equal(t, []int{1}, got)
+		require.EqualValues(t, 2, calls.Load())
+	})
+
+	t.Run("should skip failed records and continue", func(t *testing.T) {
+		var calls atomic.Int32
+		p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5))
+		p.Map(failOn(&calls, even), pipe.SkipOnError[record]())
+
+		var got []int
+		err := p.Sink(func(r *record) error {
+			got = append(got, r.value)
+			return nil
+		})
+		require.True(t, pipe.IsSkipped(err))
+		require.ElementsMatch(t, []int{1, 3, 5}, got)
+
+		var errs *pipe.Errors
+		require.ErrorAs(t, err, &errs)
+		require.Equal(t, 2, errs.TotalSkipped)
+		require.Len(t, errs.Skipped, 2)
+	})
+
+	t.Run("should only keep the first skipped errors", func(t *testing.T) {
+		values := make([]int, 150)
+		for i := range values {
+			values[i] = i
+		}
+
+		var calls atomic.Int32
+		p := pipe.New(context.Background(), sourceOf(values...))
+		p.Map(failOn(&calls, always), pipe.SkipOnError[record]())
+
+		err := p.Sink(func(_ *record) error { return nil })
+		var errs *pipe.Errors
+		require.ErrorAs(t, err, &errs)
+		require.Equal(t, 150, errs.TotalSkipped)
+		// maxCollectedErrors
+		require.Len(t, errs.Skipped, 100)
+		require.Contains(t, err.Error(), "150 skipped errors")
+	})
+
+	for name, opt := range map[string]pipe.StageOption[record]{
+		"skipping":  pipe.SkipOnError[record](),
+		"fail-fast": pipe.FailOnError[record](),
+	} {
+		t.Run("should ignore errors of cancelled calls when "+name, func(t *testing.T) {
+			started := make(chan struct{}, 4)
+			observer := &finishObserver{done: make(chan struct{})}
+			p := pipe.New(context.Background(), sourceOf(1, 2, 3, 4, 5), pipe.WithObserver[record](observer))
+			p.Map(func(ctx context.Context, r *record) (*record, error) {
+				if r.value == 1 {
+					return r, nil
+				}
+
+				started <- struct{}{}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}, pipe.Name[record]("map"), pipe.Concurrency[record](5), pipe.Retry[record](1, 0), opt)
+
+			// the other calls fail while the sink is busy, so before Sink returns
+			err := p.Sink(func(_ *record) error {
+				for i := 0; i < 4; i++ {
+					<-started
+				}
+				p.Stop()
+				<-observer.done
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+// finishObserver closes done once the stage named map has returned.
+type finishObserver struct {
+	pipe.NopObserver
+	done chan struct{}
+}
+
+func (o *finishObserver) StageFinished(stage string, _ time.Duration) {
+	if stage == "map" {
+		close(o.done)
+	}
+}
@@ -0,0 +1,93 @@
+package pipe
+
+import (
+	"context"
+	"time"
+)
+
+// takeStage forwards records until enough of them are accepted, then stops the whole pipe.
+type takeStage[R any] struct {
+	stageBase
+	n            int
+	accept       func(*R) bool
+	softDeadline time.Duration
+	stop         func()
+}
+
+type TakeStageOption[R any] interface {
+	applyTake(s *takeStage[R])
+}
+
+type takeStageOption[R any] func(s *takeStage[R])
+
+func (o takeStageOption[R]) applyTake(s *takeStage[R]) { o(s) }
+
+// TakeIf only counts records matching accept towards the limit. Other records are still forwarded.
+func TakeIf[R any](accept func(*R) bool) TakeStageOption[R] {
+	return takeStageOption[R](func(s *takeStage[R]) {
+		s.accept = accept
+	})
+}
+
+// SoftDeadline stops the pipe once the deadline has passed and at least one record was forwarded.
+func SoftDeadline[R any](deadline time.Duration) TakeStageOption[R] {
+	return takeStageOption[R](func(s *takeStage[R]) {
+		s.softDeadline = deadline
+	})
+}
+
+func (s *takeStage[R]) process(ctx context.Context, inCh <-chan *R, outCh chan<- *R) {
+	defer close(outCh)
+	defer s.track()()
+
+	var deadlineCh <-chan time.Time
+	if s.softDeadline > 0 {
+		timer := s.clock.NewTimer(s.softDeadline)
+		defer timer.Stop()
+		deadlineCh = timer.C()
+	}
+
+	accepted := 0
+	forwarded := 0
+	deadlinePassed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadlineCh:
+			deadlineCh = nil
+			deadlinePassed = true
+			if forwarded > 0 {
+				s.stop()
+				return
+			}
+		case r, ok := <-inCh:
+			if !ok {
+				// inCh is closed
+				return
+			}
+
+			s.observer.RecordIn(s.name)
+			select {
+			case outCh <- r:
+				s.observer.RecordsOut(s.name, 1)
+			case <-ctx.Done():
+				return
+			}
+
+			forwarded++
+			if s.accept == nil || s.accept(r) {
+				accepted++
+			}
+
+			if accepted >= s.n || deadlinePassed {
+				s.stop()
+				return
+			}
+		}
+	}
+}
+
+func (s *takeStage[R]) getBufSize() int {
+	return 0
+}
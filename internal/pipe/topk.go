@@ -0,0 +1,81 @@
+package pipe
+
+import (
+	"container/heap"
+	"slices"
+)
+
+// TopK keeps the best n records seen by its Sink, so memory stays bounded however many records reach it.
+// cmp orders records like slices.SortFunc: a negative result means a is better than b.
+// It isn't safe for concurrent use, which is fine as Pipe.Sink calls the sink from a single goroutine.
+type TopK[R any] struct {
+	n    int
+	cmp  func(a, b *R) int
+	heap *worstFirst[R]
+}
+
+func NewTopK[R any](n int, cmp func(a, b *R) int) *TopK[R] {
+	return &TopK[R]{
+		n:   n,
+		cmp: cmp,
+		heap: &worstFirst[R]{
+			data: make([]*R, 0, n),
+			cmp:  cmp,
+		},
+	}
+}
+
+// Sink keeps r if it's among the best n records so far. It can be passed to Pipe.Sink.
+func (t *TopK[R]) Sink(r *R) error {
+	if t.n <= 0 {
+		return nil
+	}
+
+	if t.heap.Len() < t.n {
+		heap.Push(t.heap, r)
+		return nil
+	}
+
+	// ties keep the record which came first
+	if t.cmp(r, t.heap.data[0]) < 0 {
+		t.heap.data[0] = r
+		heap.Fix(t.heap, 0)
+	}
+
+	return nil
+}
+
+// Results returns the records kept, best first.
+func (t *TopK[R]) Results() []*R {
+	results := slices.Clone(t.heap.data)
+	slices.SortStableFunc(results, t.cmp)
+	return results
+}
+
+// worstFirst is a heap with the worst record at the top, so it's the one to be replaced.
+type worstFirst[R any] struct {
+	data []*R
+	cmp  func(a, b *R) int
+}
+
+func (h worstFirst[R]) Len() int { return len(h.data) }
+
+func (h worstFirst[R]) Less(i, j int) bool {
+	return h.cmp(h.data[i], h.data[j]) > 0
+}
+
+func (h worstFirst[R]) Swap(i, j int) {
+	h.data[i], h.data[j] = h.data[j], h.data[i]
+}
+
+func (h *worstFirst[R]) Push(x any) {
+	h.data = append(h.data, x.(*R))
+}
+
+func (h *worstFirst[R]) Pop() any {
+	n := len(h.data)
+	item := h.data[n-1]
+	h.data[n-1] = nil // avoid memory leak
+	h.data = h.data[0 : n-1]
+	return item
+}
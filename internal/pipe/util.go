@@ -1,13 +1,15 @@
 package pipe
 
-func SendRecords[R any](records []R, outCh chan<- R, stopped <-chan struct{}) {
+import "context"
+
+func SendRecords[R any](ctx context.Context, records []R, outCh chan<- R) {
 	for _, record := range records {
 		select {
-		case <-stopped:
+		case <-ctx.Done():
 			return
 		default:
 			select {
-			case <-stopped:
+			case <-ctx.Done():
 				return
 			case outCh <- record:
 			}
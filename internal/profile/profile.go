@@ -0,0 +1,164 @@
+package profile
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"regexp"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	idSize = 16
+	// touchInterval limits how often reads record that a profile is used, as it's a write.
+	touchInterval = 24 * time.Hour
+)
+
+var (
+	ErrNotFound = errors.New("profile: not found")
+
+	idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Store keeps user configurations server-side so that install URLs only carry a random ID.
+type Store struct {
+	db *sql.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only supports a single writer.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		PRAGMA journal_mode = WAL;
+		PRAGMA busy_timeout = 5000;
+		CREATE TABLE IF NOT EXISTS profiles (
+			id         TEXT PRIMARY KEY,
+			data       TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			-- updated_at is when the profile was last saved or used
+			updated_at INTEGER NOT NULL
+		);
+	`)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &Store{
+		db: db,
+	}, nil
+}
+
+// IsID reports whether s looks like a profile ID rather than an inline configuration.
+func IsID(s string) bool {
+	return idPattern.MatchString(s)
+}
+
+// Create stores data under a new random ID.
+func (s *Store) Create(ctx context.Context, data string) (string, error) {
+	rawID := make([]byte, idSize)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(rawID)
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO profiles (id, data, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+		id, data, now, now,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Update replaces the data of an existing profile.
+func (s *Store) Update(ctx context.Context, id string, data string) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE profiles SET data = ?, updated_at = ? WHERE id = ?`,
+		data, time.Now().Unix(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Get returns the data of a profile and records that it's used, so it doesn't expire.
+func (s *Store) Get(ctx context.Context, id string) (string, error) {
+	var data string
+	var updatedAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT data, updated_at FROM profiles WHERE id = ?`, id).Scan(&data, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(updatedAt, 0)) > touchInterval {
+		// a failure only shortens the life of the profile
+		_, _ = s.db.ExecContext(ctx, `UPDATE profiles SET updated_at = ? WHERE id = ?`, now.Unix(), id)
+	}
+
+	return data, nil
+}
+
+// Prune deletes the profiles which haven't been saved or used since before and returns how many were deleted.
+func (s *Store) Prune(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM profiles WHERE updated_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ExpireUnused prunes the profiles unused for maxAge every interval until ctx is done.
+func (s *Store) ExpireUnused(ctx context.Context, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if deleted, err := s.Prune(ctx, time.Now().Add(-maxAge)); err != nil {
+			slog.WarnContext(ctx, "Failed to prune profiles", "error", err)
+		} else if deleted > 0 {
+			slog.InfoContext(ctx, "Pruned unused profiles", "profiles", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,62 @@
+package profile_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := profile.Open(filepath.Join(t.TempDir(), "profiles.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	t.Run("should create and update profiles", func(t *testing.T) {
+		id, err := store.Create(ctx, "first")
+		require.NoError(t, err)
+		require.True(t, profile.IsID(id))
+
+		data, err := store.Get(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, "first", data)
+
+		require.NoError(t, store.Update(ctx, id, "second"))
+		data, err = store.Get(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, "second", data)
+	})
+
+	t.Run("should return ErrNotFound for unknown profiles", func(t *testing.T) {
+		_, err := store.Get(ctx, "00000000000000000000000000000000")
+		require.ErrorIs(t, err, profile.ErrNotFound)
+
+		err = store.Update(ctx, "00000000000000000000000000000000", "data")
+		require.ErrorIs(t, err, profile.ErrNotFound)
+	})
+
+	t.Run("should prune profiles unused since the cutoff", func(t *testing.T) {
+		id, err := store.Create(ctx, "data")
+		require.NoError(t, err)
+
+		deleted, err := store.Prune(ctx, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+
+		deleted, err = store.Prune(ctx, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Positive(t, deleted)
+
+		_, err = store.Get(ctx, id)
+		require.ErrorIs(t, err, profile.ErrNotFound)
+	})
+
+	t.Run("should tell IDs from inline configurations", func(t *testing.T) {
+		require.False(t, profile.IsID("%7B%22rd%22%3A%22token%22%7D"))
+		require.False(t, profile.IsID("AZRrX0pMfH6XQqZbJ9cLhG8lx4zS3bPJk2GeS1N5y4YrI0g9"))
+	})
+}
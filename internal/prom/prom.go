@@ -0,0 +1,157 @@
+// Package prom exports the metrics of the server, e.g. request latencies and outcomes of stream requests.
+// The recording methods of a nil *Metrics are no-ops, so metrics are optional.
+package prom
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The outcomes of a stream request.
+const (
+	OutcomeResults = "results"
+	OutcomeEmpty   = "empty"
+	OutcomeTimeout = "timeout"
+)
+
+// UserIndexer labels the indexers of Prowlarr instances configured by users, as their names are unbounded.
+const UserIndexer = "user"
+
+// The caches whose hits and misses are counted.
+const (
+	CacheInfoHash    = "infohash"
+	CacheDownloadURL = "download_url"
+)
+
+type Metrics struct {
+	requestDuration *prometheus.HistogramVec
+	streamResponses *prometheus.CounterVec
+	streamResults   *prometheus.HistogramVec
+	indexerSearch   *prometheus.HistogramVec
+	indexerErrors   *prometheus.CounterVec
+	debridRequests  *prometheus.CounterVec
+	cacheLookups    *prometheus.CounterVec
+}
+
+// New creates Metrics and registers them to reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 13),
+		}, []string{"method", "route", "status"}),
+		streamResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stream_responses_total",
+			Help: "Stream responses by content type and outcome (results, empty or timeout).",
+		}, []string{"type", "outcome"}),
+		streamResults: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stream_results",
+			Help:    "Streams returned per stream request.",
+			Buckets: prometheus.LinearBuckets(0, 1, 6),
+		}, []string{"type"}),
+		indexerSearch: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "indexer_search_duration_seconds",
+			Help:    "Latency of searches by indexer of the configured Prowlarr, user for the other ones.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"indexer"}),
+		indexerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "indexer_search_errors_total",
+			Help: "Failed searches by indexer of the configured Prowlarr, user for the other ones.",
+		}, []string{"indexer"}),
+		debridRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "realdebrid_requests_total",
+			Help: "Requests to the Real-Debrid API by endpoint, HTTP status and RD error code.",
+		}, []string{"endpoint", "status", "error_code"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cache_lookups_total",
+			Help: "Cache lookups by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+	}
+
+	reg.MustRegister(
+		m.requestDuration,
+		m.streamResponses,
+		m.streamResults,
+		m.indexerSearch,
+		m.indexerErrors,
+		m.debridRequests,
+		m.cacheLookups,
+	)
+	return m
+}
+
+// Middleware observes the latency of requests by the route they matched, so paths with user data aren't labels.
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		startedAt := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if fiberErr, ok := err.(*fiber.Error); ok {
+			status = fiberErr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		m.requestDuration.
+			WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(status)).
+			Observe(time.Since(startedAt).Seconds())
+		return err
+	}
+}
+
+// StreamResponse counts a response to a stream request with n streams.
+func (m *Metrics) StreamResponse(contentType string, n int, timedOut bool) {
+	if m == nil {
+		return
+	}
+
+	outcome := OutcomeResults
+	if timedOut {
+		outcome = OutcomeTimeout
+	} else if n == 0 {
+		outcome = OutcomeEmpty
+	}
+
+	m.streamResponses.WithLabelValues(contentType, outcome).Inc()
+	m.streamResults.WithLabelValues(contentType).Observe(float64(n))
+}
+
+// IndexerSearch observes a search of an indexer, which should be UserIndexer unless it's one of the configured Prowlarr.
+func (m *Metrics) IndexerSearch(indexer string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.indexerSearch.WithLabelValues(indexer).Observe(latency.Seconds())
+	if err != nil {
+		m.indexerErrors.WithLabelValues(indexer).Inc()
+	}
+}
+
+// DebridRequest counts a request to the RD API, it's a realdebrid.RequestObserver.
+func (m *Metrics) DebridRequest(endpoint string, status int, errorCode int) {
+	if m == nil {
+		return
+	}
+
+	m.debridRequests.WithLabelValues(endpoint, strconv.Itoa(status), strconv.Itoa(errorCode)).Inc()
+}
+
+// CacheLookup counts a lookup of cache.
+func (m *Metrics) CacheLookup(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
@@ -0,0 +1,74 @@
+package prom
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := New(reg)
+
+	t.Run("should label requests by route", func(t *testing.T) {
+		app := fiber.New()
+		app.Use(metrics.Middleware())
+		app.Get("/:userData/stream/:type/:id.json", func(c *fiber.Ctx) error {
+			return fiber.ErrTooManyRequests
+		})
+
+		_, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/secret/stream/movie/tt1.json", nil))
+		require.NoError(t, err)
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		labels := map[string]string{}
+		for _, family := range families {
+			if family.GetName() == "http_request_duration_seconds" {
+				require.Len(t, family.GetMetric(), 1)
+				for _, label := range family.GetMetric()[0].GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+			}
+		}
+		require.Equal(t, map[string]string{
+			"method": fiber.MethodGet,
+			"route":  "/:userData/stream/:type/:id.json",
+			"status": "429",
+		}, labels)
+	})
+
+	t.Run("should count stream outcomes", func(t *testing.T) {
+		metrics.StreamResponse("movie", 3, false)
+		metrics.StreamResponse("movie", 0, false)
+		metrics.StreamResponse("movie", 1, true)
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.streamResponses.WithLabelValues("movie", OutcomeResults)))
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.streamResponses.WithLabelValues("movie", OutcomeEmpty)))
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.streamResponses.WithLabelValues("movie", OutcomeTimeout)))
+	})
+
+	t.Run("should count errors, RD requests and cache lookups", func(t *testing.T) {
+		metrics.IndexerSearch("indexer", time.Second, nil)
+		metrics.IndexerSearch("indexer", time.Second, fiber.ErrBadGateway)
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.indexerErrors.WithLabelValues("indexer")))
+
+		metrics.DebridRequest("/torrents/info", 401, 8)
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.debridRequests.WithLabelValues("/torrents/info", "401", "8")))
+
+		metrics.CacheLookup(CacheInfoHash, true)
+		metrics.CacheLookup(CacheInfoHash, false)
+		require.Equal(t, 1.0, testutil.ToFloat64(metrics.cacheLookups.WithLabelValues(CacheInfoHash, "hit")))
+	})
+
+	t.Run("should ignore recordings without metrics", func(t *testing.T) {
+		var nilMetrics *Metrics
+		nilMetrics.StreamResponse("movie", 1, false)
+		nilMetrics.IndexerSearch("indexer", time.Second, nil)
+		nilMetrics.DebridRequest("/user", 200, 0)
+		nilMetrics.CacheLookup(CacheDownloadURL, true)
+	})
+}
@@ -0,0 +1,183 @@
+package prowlarr
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultIndexersTTL = time.Minute
+	defaultSearchTTL   = 5 * time.Minute
+	defaultMaxEntries  = 10000
+	// fetchTimeout bounds a coalesced request, which outlives the callers giving up on it.
+	fetchTimeout = 30 * time.Second
+)
+
+type entryKind int
+
+const (
+	indexersEntry entryKind = iota
+	searchEntry
+)
+
+type CacheConfig struct {
+	// IndexersTTL is how long the list of indexers is kept.
+	IndexersTTL time.Duration
+	// SearchTTL is how long search results are kept.
+	SearchTTL time.Duration
+	// MaxEntries caps the number of responses kept, the oldest ones are evicted first.
+	MaxEntries int
+}
+
+type cacheEntry struct {
+	key       string
+	data      []byte
+	expiresAt time.Time
+}
+
+// Cache keeps recent responses of Prowlarr and coalesces identical requests in flight.
+// It's shared by all clients, entries are keyed by the Prowlarr instance and its API key.
+// Responses are kept encoded, so every caller gets its own copy to modify.
+type Cache struct {
+	cfg   CacheConfig
+	now   func() time.Time
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order lists the entries from the oldest to the newest
+	order     *list.List
+	lastSweep time.Time
+}
+
+func NewCache(cfg CacheConfig) *Cache {
+	if cfg.IndexersTTL <= 0 {
+		cfg.IndexersTTL = defaultIndexersTTL
+	}
+
+	if cfg.SearchTTL <= 0 {
+		cfg.SearchTTL = defaultSearchTTL
+	}
+
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultMaxEntries
+	}
+
+	return &Cache{
+		cfg:     cfg,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *Cache) ttl(kind entryKind) time.Duration {
+	if kind == indexersEntry {
+		return c.cfg.IndexersTTL
+	}
+
+	return c.cfg.SearchTTL
+}
+
+func (c *Cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.data, true
+}
+
+func (c *Cache) set(key string, data []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	// expired entries are swept at most once per search TTL to keep sets cheap
+	if now.Sub(c.lastSweep) >= c.cfg.SearchTTL {
+		for elem := c.order.Front(); elem != nil; {
+			next := elem.Next()
+			if !now.Before(elem.Value.(*cacheEntry).expiresAt) {
+				c.remove(elem)
+			}
+			elem = next
+		}
+		c.lastSweep = now
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	for c.order.Len() >= c.cfg.MaxEntries {
+		c.remove(c.order.Front())
+	}
+
+	c.entries[key] = c.order.PushBack(&cacheEntry{
+		key:       key,
+		data:      data,
+		expiresAt: now.Add(ttl),
+	})
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// fetchCached returns the cached response for key or fetches it. Concurrent calls with the same key
+// share a single fetch, which isn't cancelled when one of the callers gives up. Errors aren't cached.
+func fetchCached[T any](ctx context.Context, c *Cache, kind entryKind, key string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	if c == nil {
+		return fetch(ctx)
+	}
+
+	if data, ok := c.get(key); ok {
+		err := json.Unmarshal(data, &result)
+		return result, err
+	}
+
+	resultCh := c.group.DoChan(key, func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+		defer cancel()
+
+		v, err := fetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		c.set(key, data, c.ttl(kind))
+		return data, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return result, ctx.Err()
+	case res := <-resultCh:
+		if res.Err != nil {
+			return result, res.Err
+		}
+
+		err := json.Unmarshal(res.Val.([]byte), &result)
+		return result, err
+	}
+}
@@ -0,0 +1,126 @@
+package prowlarr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1/indexer" {
+			_, _ = w.Write([]byte(`[{"id":1,"name":"indexer","enable":true}]`))
+			return
+		}
+		if r.URL.Path == "/api/v1/indexerstatus" {
+			_, _ = w.Write([]byte(`[{"indexerId":1,"disabledTill":"2024-01-01T00:00:00Z"}]`))
+			return
+		}
+
+		<-release
+		_, _ = w.Write([]byte(`[{"title":"Big Buck Bunny 2008","infoHash":"ABC","guid":"1"}]`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	cache := NewCache(CacheConfig{SearchTTL: time.Minute})
+	cache.now = func() time.Time { return now }
+	client := New(server.URL, "key", WithCache(cache))
+	indexer := &Indexer{ID: 1, Name: "indexer"}
+
+	t.Run("should coalesce identical searches", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		results := make([][]*Torrent, 5)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				torrents, err := client.SearchMovieTorrents(context.Background(), indexer, "Big Buck Bunny")
+				require.NoError(t, err)
+				results[i] = torrents
+			}()
+		}
+
+		require.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		require.Equal(t, int32(1), requests.Load())
+		require.Equal(t, "abc", results[0][0].InfoHash)
+		// every caller gets its own copy
+		require.NotSame(t, results[0][0], results[1][0])
+	})
+
+	t.Run("should serve searches from the cache", func(t *testing.T) {
+		_, err := client.SearchMovieTorrents(context.Background(), indexer, "Big Buck Bunny")
+		require.NoError(t, err)
+		require.Equal(t, int32(1), requests.Load())
+
+		_, err = client.SearchSeriesTorrents(context.Background(), indexer, "Big Buck Bunny")
+		require.NoError(t, err)
+		require.Equal(t, int32(2), requests.Load())
+
+		other := New(server.URL, "other-key", WithCache(cache))
+		_, err = other.SearchMovieTorrents(context.Background(), indexer, "Big Buck Bunny")
+		require.NoError(t, err)
+		require.Equal(t, int32(3), requests.Load())
+	})
+
+	t.Run("should expire entries", func(t *testing.T) {
+		indexers, err := client.GetAllIndexers(context.Background())
+		require.NoError(t, err)
+		require.Len(t, indexers, 1)
+		require.Equal(t, int32(4), requests.Load())
+
+		now = now.Add(time.Minute)
+		_, err = client.GetAllIndexers(context.Background())
+		require.NoError(t, err)
+		_, err = client.SearchMovieTorrents(context.Background(), indexer, "Big Buck Bunny")
+		require.NoError(t, err)
+		require.Equal(t, int32(6), requests.Load())
+	})
+
+	t.Run("should cache indexer statuses", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			statuses, err := client.GetIndexerStatuses(context.Background())
+			require.NoError(t, err)
+			require.Len(t, statuses, 1)
+			require.Equal(t, 1, statuses[0].IndexerID)
+		}
+		require.Equal(t, int32(7), requests.Load())
+
+		now = now.Add(time.Minute)
+		_, err := client.GetIndexerStatuses(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int32(8), requests.Load())
+	})
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	cache := NewCache(CacheConfig{MaxEntries: 2})
+	cache.set("a", []byte("1"), time.Minute)
+	cache.set("b", []byte("2"), time.Minute)
+	cache.set("a", []byte("3"), time.Minute)
+	cache.set("c", []byte("4"), time.Minute)
+
+	_, ok := cache.get("b")
+	require.False(t, ok, "the oldest entry should be evicted")
+
+	data, ok := cache.get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), data)
+
+	_, ok = cache.get("c")
+	require.True(t, ok)
+	require.Len(t, cache.entries, 2)
+}
@@ -2,6 +2,7 @@ package prowlarr
 
 import (
 	"encoding/hex"
+	"time"
 )
 
 type TorrentID []byte
@@ -14,9 +15,24 @@ type Indexer struct {
 	Capabilities IndexerCapabilities `json:"capabilities"`
 }
 
+type IndexerStatus struct {
+	IndexerID         int       `json:"indexerId"`
+	DisabledTill      time.Time `json:"disabledTill"`
+	MostRecentFailure time.Time `json:"mostRecentFailure"`
+}
+
 type IndexerCapabilities struct {
-	LimitMax      int `json:"limitsMax"`
-	LimitDefaults int `json:"limitsDefault"`
+	LimitMax          int      `json:"limitsMax"`
+	LimitDefaults     int      `json:"limitsDefault"`
+	MovieSearchParams []string `json:"movieSearchParams"`
+	TvSearchParams    []string `json:"tvSearchParams"`
+}
+
+// MediaIDs identify a title in the metadata databases, zero means the ID is unknown.
+type MediaIDs struct {
+	IMDB uint
+	TMDB uint
+	TVDB uint
 }
 
 type Torrent struct {
@@ -2,44 +2,78 @@ package prowlarr
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/go-resty/resty/v2"
-	"github.com/gofiber/fiber/v2/log"
 )
 
 const (
 	moviesCategory = "2000"
 	tvCategory     = "5000"
+	maxRedirects   = 10
 )
 
 type Prowlarr struct {
 	client *resty.Client
 	apiURL string
+	cache  *Cache
+	// cacheKey identifies the instance and its API key in the cache.
+	cacheKey string
 }
 
-func New(apiURL string, apiKey string) *Prowlarr {
+type Option func(*Prowlarr)
+
+// WithTransport makes the client use transport, e.g. to share connections or to guard outbound requests.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(j *Prowlarr) {
+		j.client.SetTransport(transport)
+	}
+}
+
+// WithCache shares recent responses with the other clients using cache.
+func WithCache(cache *Cache) Option {
+	return func(j *Prowlarr) {
+		j.cache = cache
+	}
+}
+
+func New(apiURL string, apiKey string, opts ...Option) *Prowlarr {
 	client := resty.New().
-		// SetDebug(true).
 		SetBaseURL(apiURL).
 		SetHeader("X-Api-Key", apiKey).
-		SetRedirectPolicy(NotFollowMagnet())
+		SetRedirectPolicy(NotFollowMagnet(), resty.FlexibleRedirectPolicy(maxRedirects))
 
-	return &Prowlarr{
-		client: client,
-		apiURL: apiURL,
+	j := &Prowlarr{
+		client:   client,
+		apiURL:   apiURL,
+		cacheKey: hex.EncodeToString(generateGID(apiURL + "\x00" + apiKey)),
 	}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+func (j *Prowlarr) GetAllIndexers(ctx context.Context) ([]*Indexer, error) {
+	return fetchCached(ctx, j.cache, indexersEntry, "indexers|"+j.cacheKey, j.getAllIndexers)
 }
 
-func (j *Prowlarr) GetAllIndexers() ([]*Indexer, error) {
+func (j *Prowlarr) getAllIndexers(ctx context.Context) ([]*Indexer, error) {
 	result := []*Indexer{}
 	resp, err := j.client.
 		R().
+		SetContext(ctx).
 		SetResult(&result).
 		Get("/api/v1/indexer")
 
@@ -54,10 +88,48 @@ func (j *Prowlarr) GetAllIndexers() ([]*Indexer, error) {
 	return result, nil
 }
 
-func (j *Prowlarr) SearchMovieTorrents(indexer *Indexer, name string) ([]*Torrent, error) {
+// APIURL returns the URL of the Prowlarr instance, e.g. to key per-instance state.
+func (j *Prowlarr) APIURL() string {
+	return j.apiURL
+}
+
+// GetIndexerStatuses returns the indexers Prowlarr itself has disabled after failures.
+// They're cached as long as the list of indexers.
+func (j *Prowlarr) GetIndexerStatuses(ctx context.Context) ([]*IndexerStatus, error) {
+	return fetchCached(ctx, j.cache, indexersEntry, "indexerstatus|"+j.cacheKey, j.getIndexerStatuses)
+}
+
+func (j *Prowlarr) getIndexerStatuses(ctx context.Context) ([]*IndexerStatus, error) {
+	result := []*IndexerStatus{}
+	resp, err := j.client.
+		R().
+		SetContext(ctx).
+		SetResult(&result).
+		Get("/api/v1/indexerstatus")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.IsError() {
+		return nil, fmt.Errorf("error response from prowlarr: %v", resp.Error())
+	}
+
+	return result, nil
+}
+
+func (j *Prowlarr) SearchMovieTorrents(ctx context.Context, indexer *Indexer, name string) ([]*Torrent, error) {
+	key := j.searchKey(indexer, name, moviesCategory, "movie")
+	return fetchCached(ctx, j.cache, searchEntry, key, func(ctx context.Context) ([]*Torrent, error) {
+		return j.searchMovieTorrents(ctx, indexer, name)
+	})
+}
+
+func (j *Prowlarr) searchMovieTorrents(ctx context.Context, indexer *Indexer, name string) ([]*Torrent, error) {
 	result := []*Torrent{}
 	resp, err := j.client.
 		R().
+		SetContext(ctx).
 		SetQueryParam("query", name).
 		SetQueryParam("categories", moviesCategory).
 		SetQueryParam("type", "movie").
@@ -66,12 +138,12 @@ func (j *Prowlarr) SearchMovieTorrents(indexer *Indexer, name string) ([]*Torren
 		Get("/api/v1/search")
 
 	if err != nil {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, err)
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, resp.Error())
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "status", resp.StatusCode())
 		return nil, fmt.Errorf("error response from prowlarr: %v", resp.Error())
 	}
 
@@ -84,10 +156,18 @@ func (j *Prowlarr) SearchMovieTorrents(indexer *Indexer, name string) ([]*Torren
 	return result, nil
 }
 
-func (j *Prowlarr) SearchSeasonTorrents(indexer *Indexer, name string, season int) ([]*Torrent, error) {
+func (j *Prowlarr) SearchSeasonTorrents(ctx context.Context, indexer *Indexer, name string, season int) ([]*Torrent, error) {
+	key := j.searchKey(indexer, fmt.Sprintf("%s{Season:%02d}", name, season), tvCategory, "tvsearch")
+	return fetchCached(ctx, j.cache, searchEntry, key, func(ctx context.Context) ([]*Torrent, error) {
+		return j.searchSeasonTorrents(ctx, indexer, name, season)
+	})
+}
+
+func (j *Prowlarr) searchSeasonTorrents(ctx context.Context, indexer *Indexer, name string, season int) ([]*Torrent, error) {
 	result := []*Torrent{}
 	resp, err := j.client.
 		R().
+		SetContext(ctx).
 		SetQueryParam("query", fmt.Sprintf("%s{Season:%02d}", name, season)).
 		SetQueryParam("categories", tvCategory).
 		SetQueryParam("type", "tvsearch").
@@ -96,12 +176,12 @@ func (j *Prowlarr) SearchSeasonTorrents(indexer *Indexer, name string, season in
 		Get("/api/v1/search")
 
 	if err != nil {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, err)
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, resp.Error())
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "status", resp.StatusCode())
 		return nil, fmt.Errorf("error response from prowlarr: %v", resp.Error())
 	}
 
@@ -114,10 +194,18 @@ func (j *Prowlarr) SearchSeasonTorrents(indexer *Indexer, name string, season in
 	return result, nil
 }
 
-func (j *Prowlarr) SearchSeriesTorrents(indexer *Indexer, name string) ([]*Torrent, error) {
+func (j *Prowlarr) SearchSeriesTorrents(ctx context.Context, indexer *Indexer, name string) ([]*Torrent, error) {
+	key := j.searchKey(indexer, name, tvCategory, "tvsearch")
+	return fetchCached(ctx, j.cache, searchEntry, key, func(ctx context.Context) ([]*Torrent, error) {
+		return j.searchSeriesTorrents(ctx, indexer, name)
+	})
+}
+
+func (j *Prowlarr) searchSeriesTorrents(ctx context.Context, indexer *Indexer, name string) ([]*Torrent, error) {
 	result := []*Torrent{}
 	resp, err := j.client.
 		R().
+		SetContext(ctx).
 		SetQueryParam("query", name).
 		SetQueryParam("categories", tvCategory).
 		SetQueryParam("type", "tvsearch").
@@ -126,12 +214,12 @@ func (j *Prowlarr) SearchSeriesTorrents(indexer *Indexer, name string) ([]*Torre
 		Get("/api/v1/search")
 
 	if err != nil {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, err)
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "error", err)
 		return nil, err
 	}
 
 	if resp.IsError() {
-		log.Errorf("Failed to search for %v from %v: %v", name, indexer.Name, resp.Error())
+		slog.ErrorContext(ctx, "Failed to search", "query", name, "indexer", indexer.Name, "status", resp.StatusCode())
 		return nil, fmt.Errorf("error response from prowlarr: %v", resp.Error())
 	}
 
@@ -142,22 +230,73 @@ func (j *Prowlarr) SearchSeriesTorrents(indexer *Indexer, name string) ([]*Torre
 	return result, nil
 }
 
-func (j *Prowlarr) FetchInfoHash(torrent *Torrent) (*Torrent, error) {
+// SearchMovieTorrentsByID searches the indexer by the IDs of a movie it supports.
+// Unsupported IDs are left out, so check SupportsMovieIDs first.
+func (j *Prowlarr) SearchMovieTorrentsByID(ctx context.Context, indexer *Indexer, ids MediaIDs) ([]*Torrent, error) {
+	return j.SearchMovieTorrents(ctx, indexer, idQuery(ids, indexer.Capabilities.MovieSearchParams))
+}
+
+// SearchSeriesTorrentsByID searches the indexer by the IDs of a series it supports.
+// Unsupported IDs are left out, so check SupportsSeriesIDs first.
+func (j *Prowlarr) SearchSeriesTorrentsByID(ctx context.Context, indexer *Indexer, ids MediaIDs) ([]*Torrent, error) {
+	return j.SearchSeriesTorrents(ctx, indexer, idQuery(ids, indexer.Capabilities.TvSearchParams))
+}
+
+// SupportsMovieIDs reports whether the indexer can search movies by any of ids.
+func (i *Indexer) SupportsMovieIDs(ids MediaIDs) bool {
+	return idQuery(ids, i.Capabilities.MovieSearchParams) != ""
+}
+
+// SupportsSeriesIDs reports whether the indexer can search series by any of ids.
+func (i *Indexer) SupportsSeriesIDs(ids MediaIDs) bool {
+	return idQuery(ids, i.Capabilities.TvSearchParams) != ""
+}
+
+// idQuery returns the search tokens of the known ids among the supported search params.
+// Prowlarr passes them to the indexer as the imdbid, tmdbid and tvdbid params.
+func idQuery(ids MediaIDs, params []string) string {
+	supported := map[string]bool{}
+	for _, param := range params {
+		supported[strings.ToLower(param)] = true
+	}
+
+	query := ""
+	if ids.IMDB != 0 && supported["imdbid"] {
+		query += fmt.Sprintf("{ImdbId:tt%07d}", ids.IMDB)
+	}
+
+	if ids.TMDB != 0 && supported["tmdbid"] {
+		query += fmt.Sprintf("{TmdbId:%d}", ids.TMDB)
+	}
+
+	if ids.TVDB != 0 && supported["tvdbid"] {
+		query += fmt.Sprintf("{TvdbId:%d}", ids.TVDB)
+	}
+
+	return query
+}
+
+// searchKey identifies a search in the cache by indexer, query, category and type.
+func (j *Prowlarr) searchKey(indexer *Indexer, query, categories, searchType string) string {
+	return strings.Join([]string{"search", j.cacheKey, strconv.Itoa(indexer.ID), categories, searchType, query}, "|")
+}
+
+func (j *Prowlarr) FetchInfoHash(ctx context.Context, torrent *Torrent) (*Torrent, error) {
 	if torrent.InfoHash != "" {
 		return torrent, nil
 	}
 
 	if torrent.MagnetUri == "" {
-		resp, err := j.client.R().Get(torrent.Link)
+		resp, err := j.client.R().SetContext(ctx).Get(torrent.Link)
 		if err != nil {
-			log.Errorf("Failed to fetch magnet link for %s due to: %v", torrent.Link, err)
+			slog.ErrorContext(ctx, "Failed to fetch the magnet link", "link", torrent.Link, "error", err)
 			return torrent, err
 		}
 
 		if resp.Header().Get("Content-Type") == "application/x-bittorrent" {
 			torFile, err := parseTorrentFile(bytes.NewReader(resp.Body()))
 			if err != nil {
-				log.Errorf("Invalid torrent file for %s with: %v", torrent.Link, err)
+				slog.ErrorContext(ctx, "Invalid torrent file", "link", torrent.Link, "error", err)
 				return torrent, err
 			}
 
@@ -173,7 +312,7 @@ func (j *Prowlarr) FetchInfoHash(torrent *Torrent) (*Torrent, error) {
 		}
 
 		if torrent.MagnetUri == "" {
-			log.Errorf("Unexpected magnet uri for %s, %s", torrent.Guid, torrent.Title)
+			slog.ErrorContext(ctx, "Unexpected magnet URI", "guid", torrent.Guid, "title", torrent.Title)
 			return torrent, errors.New("magnet uri is expected but not found")
 		}
 	}
@@ -206,7 +345,7 @@ func normaliseTorrent(tor *Torrent, prowlarURL string) {
 			// ThePirateBay has magnet link in Guid
 			tor.MagnetUri = tor.Guid
 		} else if tor.MagnetUri != "" {
-			log.Errorf("Invalid magnet URI %v", tor.MagnetUri)
+			slog.Warn("Invalid magnet URI", "magnet_uri", tor.MagnetUri)
 			tor.MagnetUri = ""
 		}
 	}
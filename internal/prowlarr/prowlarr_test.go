@@ -1,6 +1,9 @@
 package prowlarr_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/bongnv/prowlarr-stremio/internal/prowlarr"
@@ -14,8 +17,36 @@ func TestProwlarr_FetchMagnetURI(t *testing.T) {
 			MagnetUri: "magnet:?xt=urn:btih:9b4c1489bfccd8205d152345f7a8aad52d9a1f57&dn=archlinux-2022.05.01-x86_64.iso",
 		}
 		client := prowlarr.New("", "")
-		torrent, err = client.FetchInfoHash(torrent)
+		torrent, err = client.FetchInfoHash(context.Background(), torrent)
 		require.NoError(t, err)
 		require.Equal(t, "9b4c1489bfccd8205d152345f7a8aad52d9a1f57", torrent.InfoHash)
 	})
 }
+
+func TestProwlarr_SearchByID(t *testing.T) {
+	queries := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := prowlarr.New(server.URL, "key")
+	ids := prowlarr.MediaIDs{IMDB: 436992, TMDB: 57243, TVDB: 78804}
+
+	t.Run("should only search by the supported IDs", func(t *testing.T) {
+		indexer := &prowlarr.Indexer{ID: 1, Capabilities: prowlarr.IndexerCapabilities{TvSearchParams: []string{"q", "season", "ep", "imdbId", "tvdbId"}}}
+		require.True(t, indexer.SupportsSeriesIDs(ids))
+
+		_, err := client.SearchSeriesTorrentsByID(context.Background(), indexer, ids)
+		require.NoError(t, err)
+		require.Equal(t, "{ImdbId:tt0436992}{TvdbId:78804}", <-queries)
+	})
+
+	t.Run("should report indexers without ID searches", func(t *testing.T) {
+		indexer := &prowlarr.Indexer{ID: 2, Capabilities: prowlarr.IndexerCapabilities{MovieSearchParams: []string{"q"}}}
+		require.False(t, indexer.SupportsMovieIDs(ids))
+		require.False(t, indexer.SupportsMovieIDs(prowlarr.MediaIDs{}))
+	})
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultMaxStreamsPerUser = 2
+	retryAfterSeconds        = 5
+)
+
+var (
+	ErrTooManyStreams = errors.New("proxy: too many concurrent streams")
+	// ErrBadUpstream is returned instead of streaming an error response of the upstream to the client.
+	ErrBadUpstream = fiber.NewError(fiber.StatusBadGateway, "proxy: error response from upstream")
+
+	// forwardedHeaders are copied from the client request to the upstream request.
+	forwardedHeaders = []string{
+		fiber.HeaderRange,
+		fiber.HeaderIfRange,
+		fiber.HeaderIfModifiedSince,
+		fiber.HeaderIfNoneMatch,
+	}
+
+	// copiedHeaders are copied from the upstream response to the client response.
+	copiedHeaders = []string{
+		fiber.HeaderContentType,
+		fiber.HeaderContentRange,
+		fiber.HeaderAcceptRanges,
+		fiber.HeaderLastModified,
+		fiber.HeaderETag,
+		fiber.HeaderContentDisposition,
+	}
+)
+
+// Proxy streams upstream files to clients instead of redirecting them,
+// so the upstream only ever sees the IP address of the server.
+type Proxy struct {
+	client            *http.Client
+	maxStreamsPerUser int
+
+	mu      sync.Mutex
+	streams map[string]int
+}
+
+type Option func(*Proxy)
+
+func WithMaxStreamsPerUser(maxStreams int) Option {
+	return func(p *Proxy) {
+		p.maxStreamsPerUser = maxStreams
+	}
+}
+
+func WithTransport(transport http.RoundTripper) Option {
+	return func(p *Proxy) {
+		p.client.Transport = transport
+	}
+}
+
+func New(opts ...Option) *Proxy {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+
+	p := &Proxy{
+		client: &http.Client{
+			Transport: transport,
+		},
+		maxStreamsPerUser: defaultMaxStreamsPerUser,
+		streams:           map[string]int{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// Serve streams target to the client. It passes Range and conditional headers through
+// and keeps the stream slot of user busy until the body is fully sent or the client goes away.
+func (p *Proxy) Serve(c *fiber.Ctx, user string, target string) error {
+	release, ok := p.acquire(user)
+	if !ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfterSeconds))
+		return fiber.NewError(fiber.StatusTooManyRequests, ErrTooManyStreams.Error())
+	}
+
+	// The body is streamed after the handler returns, so the upstream request
+	// mustn't be bound to the lifetime of the handler.
+	req, err := http.NewRequestWithContext(context.Background(), c.Method(), target, nil)
+	if err != nil {
+		release()
+		return err
+	}
+
+	for _, header := range forwardedHeaders {
+		if value := c.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		release()
+		return err
+	}
+
+	if !isSuccess(resp.StatusCode) {
+		_ = resp.Body.Close()
+		release()
+		return ErrBadUpstream
+	}
+
+	c.Status(resp.StatusCode)
+	for _, header := range copiedHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			c.Set(header, value)
+		}
+	}
+
+	if c.Method() == fiber.MethodHead {
+		_ = resp.Body.Close()
+		release()
+		if resp.ContentLength >= 0 {
+			c.Response().Header.SetContentLength(int(resp.ContentLength))
+		}
+		return nil
+	}
+
+	c.Context().SetBodyStream(&releasingBody{
+		ReadCloser: resp.Body,
+		release:    release,
+	}, int(resp.ContentLength))
+	return nil
+}
+
+// isSuccess reports whether status can be passed to the client. Responses to the
+// forwarded Range and conditional headers are, the other non-2xx ones aren't.
+func isSuccess(status int) bool {
+	if status == http.StatusNotModified || status == http.StatusRequestedRangeNotSatisfiable {
+		return true
+	}
+
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// ActiveStreams returns the number of streams currently served for user.
+func (p *Proxy) ActiveStreams(user string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.streams[user]
+}
+
+func (p *Proxy) acquire(user string) (func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.maxStreamsPerUser > 0 && p.streams[user] >= p.maxStreamsPerUser {
+		return nil, false
+	}
+
+	p.streams[user]++
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.streams[user]--
+			if p.streams[user] <= 0 {
+				delete(p.streams, user)
+			}
+		})
+	}, true
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/proxy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+var content = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+func newUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/x-matroska")
+		http.ServeContent(w, r, "movie.mkv", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func newApp(p *proxy.Proxy, target string) *fiber.App {
+	app := fiber.New()
+	handler := func(c *fiber.Ctx) error {
+		return p.Serve(c, "user", target)
+	}
+	app.Get("/download", handler)
+	app.Head("/download", handler)
+	return app
+}
+
+func TestProxy_Serve(t *testing.T) {
+	upstream := newUpstream(t)
+
+	t.Run("should stream the whole file", func(t *testing.T) {
+		p := proxy.New()
+		resp, err := newApp(p, upstream.URL).Test(httptest.NewRequest(fiber.MethodGet, "/download", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		require.Equal(t, "video/x-matroska", resp.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, content, body)
+		require.Eventually(t, func() bool { return p.ActiveStreams("user") == 0 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("should pass range requests through", func(t *testing.T) {
+		req := httptest.NewRequest(fiber.MethodGet, "/download", nil)
+		req.Header.Set("Range", "bytes=10-19")
+		resp, err := newApp(proxy.New(), upstream.URL).Test(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		require.Equal(t, "bytes 10-19/36", resp.Header.Get("Content-Range"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, content[10:20], body)
+	})
+
+	t.Run("should answer HEAD requests without a body", func(t *testing.T) {
+		p := proxy.New()
+		resp, err := newApp(p, upstream.URL).Test(httptest.NewRequest(fiber.MethodHead, "/download", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "36", resp.Header.Get("Content-Length"))
+		require.Equal(t, 0, p.ActiveStreams("user"))
+	})
+
+	t.Run("should reject streams over the per-user cap", func(t *testing.T) {
+		blocked := make(chan struct{})
+		slowUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-blocked
+		}))
+		defer slowUpstream.Close()
+		defer close(blocked)
+
+		p := proxy.New(proxy.WithMaxStreamsPerUser(1))
+		app := newApp(p, slowUpstream.URL)
+		go func() {
+			_, _ = app.Test(httptest.NewRequest(fiber.MethodGet, "/download", nil), -1)
+		}()
+		require.Eventually(t, func() bool { return p.ActiveStreams("user") == 1 }, time.Second, 10*time.Millisecond)
+
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/download", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.Equal(t, "5", resp.Header.Get("Retry-After"))
+	})
+	t.Run("should not stream error responses of the upstream", func(t *testing.T) {
+		failingUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "link expired", http.StatusForbidden)
+		}))
+		defer failingUpstream.Close()
+
+		p := proxy.New()
+		resp, err := newApp(p, failingUpstream.URL).Test(httptest.NewRequest(fiber.MethodGet, "/download", nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		require.Equal(t, 0, p.ActiveStreams("user"))
+	})
+}
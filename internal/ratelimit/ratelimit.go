@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/time/rate"
+)
+
+const (
+	cleanupInterval = time.Minute
+	idleTimeout     = 10 * time.Minute
+)
+
+// KeyFunc returns the key of the bucket a request is counted against.
+// Requests with an empty key aren't counted.
+type KeyFunc func(c *fiber.Ctx) string
+
+type Config struct {
+	// PerMinute is the number of requests refilled per minute. Zero disables the limiter.
+	PerMinute int
+	// Burst is the maximum number of requests in a row.
+	Burst int
+}
+
+// Limiter is a set of token buckets, one per key.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+	now   func() time.Time
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func New(cfg Config) *Limiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &Limiter{
+		limit:   rate.Limit(float64(cfg.PerMinute) / 60),
+		burst:   burst,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Enabled reports whether the limiter restricts anything.
+func (l *Limiter) Enabled() bool {
+	return l.limit > 0
+}
+
+// Allow takes a token from the bucket of every key. If any bucket is empty, no token is taken
+// and the time to wait before retrying is returned.
+func (l *Limiter) Allow(keys ...string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now)
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		r := l.getBucket(key, now).limiter.ReserveN(now, 1)
+		reservations = append(reservations, r)
+		if delay := r.DelayFrom(now); delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+
+	if retryAfter > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		return false, retryAfter
+	}
+
+	return true, 0
+}
+
+func (l *Limiter) getBucket(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			limiter: rate.NewLimiter(l.limit, l.burst),
+		}
+		l.buckets[key] = b
+	}
+
+	b.lastSeen = now
+	return b
+}
+
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < cleanupInterval {
+		return
+	}
+
+	l.lastCleanup = now
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware rejects requests over the limit of any of the keys with 429 and a Retry-After header.
+func Middleware(l *Limiter, keyFuncs ...KeyFunc) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !l.Enabled() {
+			return c.Next()
+		}
+
+		keys := make([]string, 0, len(keyFuncs))
+		for _, keyFunc := range keyFuncs {
+			keys = append(keys, keyFunc(c))
+		}
+
+		if ok, retryAfter := l.Allow(keys...); !ok {
+			return TooManyRequests(c, retryAfter)
+		}
+
+		return c.Next()
+	}
+}
+
+// TooManyRequests responds with 429 and asks the client to retry after the given duration.
+func TooManyRequests(c *fiber.Ctx, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return fiber.NewError(fiber.StatusTooManyRequests, "too many requests")
+}
+
+// ByIP keys requests on the client IP. Forwarding headers are only honoured from the trusted proxies
+// of the app, see fiber.Config.EnableTrustedProxyCheck.
+func ByIP() KeyFunc {
+	return func(c *fiber.Ctx) string {
+		return "ip:" + c.IP()
+	}
+}
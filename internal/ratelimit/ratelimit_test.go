@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	l := New(Config{PerMinute: 60, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	t.Run("should allow bursts and refill over time", func(t *testing.T) {
+		ok, _ := l.Allow("user:a")
+		require.True(t, ok)
+		ok, _ = l.Allow("user:a")
+		require.True(t, ok)
+
+		ok, retryAfter := l.Allow("user:a")
+		require.False(t, ok)
+		require.Equal(t, time.Second, retryAfter)
+
+		now = now.Add(time.Second)
+		ok, _ = l.Allow("user:a")
+		require.True(t, ok)
+	})
+
+	t.Run("should not take tokens when another key is limited", func(t *testing.T) {
+		ok, _ := l.Allow("user:a", "ip:1")
+		require.False(t, ok)
+
+		ok, _ = l.Allow("ip:1")
+		require.True(t, ok)
+		ok, _ = l.Allow("ip:1")
+		require.True(t, ok)
+	})
+
+	t.Run("should forget idle keys", func(t *testing.T) {
+		now = now.Add(idleTimeout + cleanupInterval)
+		_, _ = l.Allow("user:b")
+		require.Len(t, l.buckets, 1)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	app := fiber.New()
+	limiter := New(Config{PerMinute: 1, Burst: 1})
+	byUser := func(c *fiber.Ctx) string { return c.Params("userData") }
+	app.Get("/:userData/stream", Middleware(limiter, byUser, ByIP()), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/token/stream", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest(fiber.MethodGet, "/token/stream", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+}
+
+func TestByIP(t *testing.T) {
+	get := func(app *fiber.App, forwardedFor string) int {
+		req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+		req.Header.Set(fiber.HeaderXForwardedFor, forwardedFor)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	newApp := func(trustedProxies []string) *fiber.App {
+		app := fiber.New(fiber.Config{
+			EnableTrustedProxyCheck: true,
+			TrustedProxies:          trustedProxies,
+			ProxyHeader:             fiber.HeaderXForwardedFor,
+		})
+		app.Get("/", Middleware(New(Config{PerMinute: 1, Burst: 1}), ByIP()), func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusOK)
+		})
+		return app
+	}
+
+	t.Run("should ignore forwarding headers of untrusted clients", func(t *testing.T) {
+		app := newApp(nil)
+		require.Equal(t, http.StatusOK, get(app, "1.1.1.1"))
+		require.Equal(t, http.StatusTooManyRequests, get(app, "2.2.2.2"))
+	})
+
+	t.Run("should honour forwarding headers of trusted proxies", func(t *testing.T) {
+		// test requests come from 0.0.0.0
+		app := newApp([]string{"0.0.0.0"})
+		require.Equal(t, http.StatusOK, get(app, "1.1.1.1"))
+		require.Equal(t, http.StatusOK, get(app, "2.2.2.2"))
+		require.Equal(t, http.StatusTooManyRequests, get(app, "1.1.1.1"))
+	})
+}
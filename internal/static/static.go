@@ -1,16 +1,47 @@
 package static
 
 import (
+	"bytes"
 	_ "embed"
+	"html/template"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-//go:embed configure.html
-var configure []byte
+const defaultProwlarrURL = "http://prowlarr:9696"
 
-func HandleConfigure(c *fiber.Ctx) error {
-	c.Response().Header.Add("Cache-control", "max-age=86400, public")
-	c.Set(fiber.HeaderContentType, fiber.MIMETextHTML)
-	return c.Send(configure)
+var (
+	//go:embed configure.html
+	configureHTML     string
+	configureTemplate = template.Must(template.New("configure").Parse(configureHTML))
+)
+
+// ConfigurePage is what the configure page is rendered with.
+type ConfigurePage struct {
+	Version        string
+	ProwlarrURL    string
+	ProwlarrAPIKey string
+	RDAPIKey       string
+	// Indexers are the indexer preferences of the user, rendered as JSON for the page script.
+	Indexers any
+}
+
+// RenderConfigure renders the configure page. Pages pre-filled with credentials aren't cached.
+func RenderConfigure(c *fiber.Ctx, page ConfigurePage) error {
+	if page.ProwlarrURL == "" {
+		page.ProwlarrURL = defaultProwlarrURL
+	}
+
+	buf := &bytes.Buffer{}
+	if err := configureTemplate.Execute(buf, page); err != nil {
+		return err
+	}
+
+	if page.RDAPIKey != "" || page.ProwlarrAPIKey != "" {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+	} else {
+		c.Set(fiber.HeaderCacheControl, "max-age=86400, public")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Send(buf.Bytes())
 }
@@ -0,0 +1,343 @@
+// Package tmdb fetches metadata from The Movie Database, which knows more titles and IDs than Cinemeta.
+package tmdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bongnv/prowlarr-stremio/internal/model"
+	"github.com/coocood/freecache"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	requestTimeout = 5 * time.Second
+	retryCount     = 2
+	retryWaitTime  = 200 * time.Millisecond
+	cacheSize      = 10 * 1024 * 1024 // 10MB
+	defaultTTL     = 24 * time.Hour
+	dateLayout     = "2006-01-02"
+)
+
+// ErrNotFound is returned when TMDB doesn't know the requested ID.
+var ErrNotFound = errors.New("meta not found")
+
+type TMDB struct {
+	client   *resty.Client
+	cache    *freecache.Cache
+	ttl      time.Duration
+	language string
+	now      func() time.Time
+}
+
+type findResponse struct {
+	MovieResults []struct {
+		ID int `json:"id"`
+	} `json:"movie_results"`
+	TVResults []struct {
+		ID int `json:"id"`
+	} `json:"tv_results"`
+}
+
+type alternativeTitle struct {
+	Country string `json:"iso_3166_1"`
+	Title   string `json:"title"`
+}
+
+type movieResponse struct {
+	Title             string `json:"title"`
+	OriginalTitle     string `json:"original_title"`
+	OriginalLanguage  string `json:"original_language"`
+	ReleaseDate       string `json:"release_date"`
+	AlternativeTitles struct {
+		Titles []alternativeTitle `json:"titles"`
+	} `json:"alternative_titles"`
+}
+
+type seriesResponse struct {
+	Name              string `json:"name"`
+	OriginalName      string `json:"original_name"`
+	OriginalLanguage  string `json:"original_language"`
+	FirstAirDate      string `json:"first_air_date"`
+	LastAirDate       string `json:"last_air_date"`
+	InProduction      bool   `json:"in_production"`
+	AlternativeTitles struct {
+		Results []alternativeTitle `json:"results"`
+	} `json:"alternative_titles"`
+	ExternalIDs struct {
+		TVDBID int `json:"tvdb_id"`
+	} `json:"external_ids"`
+}
+
+type episodeResponse struct {
+	AirDate string `json:"air_date"`
+}
+
+type Option func(*TMDB)
+
+// WithTransport makes the client use transport, e.g. to share connections or to guard outbound requests.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(t *TMDB) {
+		t.client.SetTransport(transport)
+	}
+}
+
+// WithBaseURL makes the client send requests to baseURL instead of TMDB, e.g. a stand-in server.
+func WithBaseURL(baseURL string) Option {
+	return func(t *TMDB) {
+		t.client.SetBaseURL(baseURL)
+	}
+}
+
+// WithLanguage requests localized titles in language, e.g. "fr-FR".
+func WithLanguage(language string) Option {
+	return func(t *TMDB) {
+		t.language = language
+	}
+}
+
+// New creates a client authenticated with apiKey, either a v3 API key or a v4 read access token.
+func New(apiKey string, opts ...Option) *TMDB {
+	client := resty.New().
+		SetBaseURL("https://api.themoviedb.org/3").
+		SetHeader("Accept", "application/json").
+		SetTimeout(requestTimeout).
+		SetRetryCount(retryCount).
+		SetRetryWaitTime(retryWaitTime).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return err != nil || resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= http.StatusInternalServerError
+		})
+
+	// read access tokens are JWTs, API keys are plain hex strings
+	if strings.Contains(apiKey, ".") {
+		client.SetAuthToken(apiKey)
+	} else {
+		client.SetQueryParam("api_key", apiKey)
+	}
+
+	t := &TMDB{
+		client: client,
+		cache:  freecache.NewCache(cacheSize),
+		ttl:    defaultTTL,
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+func (t *TMDB) GetMovieById(ctx context.Context, id string) (*model.MetaInfo, error) {
+	imdbID, err := parseIMDBID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &model.MetaInfo{}
+	err = t.cached(ctx, "movie/"+id, meta, func() error {
+		tmdbID, err := t.find(ctx, id, "movie")
+		if err != nil {
+			return err
+		}
+
+		movie := &movieResponse{}
+		if err := t.get(ctx, fmt.Sprintf("/movie/%d", tmdbID), movie); err != nil {
+			return err
+		}
+
+		year := parseYear(movie.ReleaseDate)
+		*meta = model.MetaInfo{
+			Name:             movie.Title,
+			FromYear:         year,
+			ToYear:           year,
+			TMDBID:           uint(tmdbID),
+			OriginalLanguage: movie.OriginalLanguage,
+			Aliases:          aliases(movie.Title, movie.OriginalTitle, movie.AlternativeTitles.Titles, region(t.language)),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	meta.IMDBID = imdbID
+	return meta, nil
+}
+
+func (t *TMDB) GetSeriesById(ctx context.Context, id string, season, episode int) (*model.MetaInfo, error) {
+	imdbID, err := parseIMDBID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &model.MetaInfo{}
+	err = t.cached(ctx, "tv/"+id, meta, func() error {
+		tmdbID, err := t.find(ctx, id, "tv")
+		if err != nil {
+			return err
+		}
+
+		series := &seriesResponse{}
+		if err := t.get(ctx, fmt.Sprintf("/tv/%d", tmdbID), series); err != nil {
+			return err
+		}
+
+		toYear := parseYear(series.LastAirDate)
+		if series.InProduction || toYear == 0 {
+			toYear = t.now().Year()
+		}
+
+		*meta = model.MetaInfo{
+			Name:             series.Name,
+			FromYear:         parseYear(series.FirstAirDate),
+			ToYear:           toYear,
+			TMDBID:           uint(tmdbID),
+			TVDBID:           uint(series.ExternalIDs.TVDBID),
+			OriginalLanguage: series.OriginalLanguage,
+			Aliases:          aliases(series.Name, series.OriginalName, series.AlternativeTitles.Results, region(t.language)),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta.IMDBID = imdbID
+
+	// the air date is optional, a search still works without it
+	episodeKey := fmt.Sprintf("tv/%s:%d:%d", id, season, episode)
+	episodeInfo := &episodeResponse{}
+	err = t.cached(ctx, episodeKey, episodeInfo, func() error {
+		path := fmt.Sprintf("/tv/%d/season/%d/episode/%d", meta.TMDBID, season, episode)
+		return t.get(ctx, path, episodeInfo)
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't fetch the air date", "id", id, "season", season, "episode", episode, "error", err)
+	}
+	meta.EpisodeYear = parseYear(episodeInfo.AirDate)
+
+	return meta, nil
+}
+
+// cached decodes the cached value of key into result, or calls fetch to fill result and caches it.
+func (t *TMDB) cached(ctx context.Context, key string, result any, fetch func() error) error {
+	if data, err := t.cache.Get([]byte(key)); err == nil {
+		if err := json.Unmarshal(data, result); err == nil {
+			return nil
+		}
+	}
+
+	if err := fetch(); err != nil {
+		return err
+	}
+
+	if data, err := json.Marshal(result); err == nil {
+		if err := t.cache.Set([]byte(key), data, int(t.ttl.Seconds())); err != nil {
+			slog.WarnContext(ctx, "Failed to cache the meta", "id", key, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// find returns the TMDB ID of an IMDb ID, mediaType is either "movie" or "tv".
+func (t *TMDB) find(ctx context.Context, imdbID, mediaType string) (int, error) {
+	result := &findResponse{}
+	req := t.client.R().SetQueryParam("external_source", "imdb_id")
+	if err := t.do(ctx, req, "/find/"+imdbID, result); err != nil {
+		return 0, err
+	}
+
+	if mediaType == "movie" && len(result.MovieResults) > 0 {
+		return result.MovieResults[0].ID, nil
+	}
+
+	if mediaType == "tv" && len(result.TVResults) > 0 {
+		return result.TVResults[0].ID, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrNotFound, imdbID)
+}
+
+func (t *TMDB) get(ctx context.Context, path string, result any) error {
+	req := t.client.R().SetQueryParam("append_to_response", "alternative_titles,external_ids")
+	if t.language != "" {
+		req.SetQueryParam("language", t.language)
+	}
+
+	return t.do(ctx, req, path, result)
+}
+
+func (t *TMDB) do(ctx context.Context, req *resty.Request, path string, result any) error {
+	resp, err := req.SetContext(ctx).SetResult(result).Get(path)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+
+	if resp.IsError() {
+		return fmt.Errorf("error response from tmdb: %s", resp.Status())
+	}
+
+	return nil
+}
+
+func parseYear(date string) int {
+	parsed, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return 0
+	}
+
+	return parsed.Year()
+}
+
+// region returns the country of language, e.g. "FR" for "fr-FR", or "" if it has none.
+func region(language string) string {
+	_, country, _ := strings.Cut(language, "-")
+	return country
+}
+
+func parseIMDBID(id string) (uint, error) {
+	parsed, err := strconv.Atoi(strings.TrimPrefix(id, "tt"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid IMDb ID %q: %w", id, err)
+	}
+
+	return uint(parsed), nil
+}
+
+// aliases returns the original title followed by the alternative titles of country which differ from name.
+// Titles of other countries are left out, they're rarely used in releases and would let unrelated ones match.
+func aliases(name, originalTitle string, alternatives []alternativeTitle, country string) []string {
+	result := []string{}
+	seen := map[string]bool{strings.ToLower(name): true}
+	titles := []string{originalTitle}
+	for _, alternative := range alternatives {
+		if country != "" && strings.EqualFold(alternative.Country, country) {
+			titles = append(titles, alternative.Title)
+		}
+	}
+
+	for _, title := range titles {
+		title = strings.TrimSpace(title)
+		if title == "" || seen[strings.ToLower(title)] {
+			continue
+		}
+
+		seen[strings.ToLower(title)] = true
+		result = append(result, title)
+	}
+
+	return result
+}
@@ -0,0 +1,123 @@
+package tmdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTMDB(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("api_key") != "key" && r.Header.Get("Authorization") != "Bearer header.payload.signature" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/3/find/tt1":
+			_, _ = w.Write([]byte(`{"movie_results":[{"id":10}],"tv_results":[]}`))
+		case "/3/find/tt2":
+			_, _ = w.Write([]byte(`{"movie_results":[],"tv_results":[{"id":20}]}`))
+		case "/3/find/tt3":
+			_, _ = w.Write([]byte(`{"movie_results":[],"tv_results":[]}`))
+		case "/3/movie/10":
+			_, _ = w.Write([]byte(`{
+				"title": "Spirited Away",
+				"original_title": "千と千尋の神隠し",
+				"original_language": "ja",
+				"release_date": "2001-07-20",
+				"alternative_titles": {"titles": [
+					{"iso_3166_1": "JP", "title": "Sen to Chihiro no Kamikakushi"},
+					{"iso_3166_1": "FR", "title": "Le Voyage de Chihiro"},
+					{"iso_3166_1": "DE", "title": "Chihiros Reise ins Zauberland"}
+				]}
+			}`))
+		case "/3/tv/20":
+			_, _ = w.Write([]byte(`{
+				"name": "Doctor Who",
+				"original_name": "Doctor Who",
+				"original_language": "en",
+				"first_air_date": "2005-03-26",
+				"last_air_date": "2022-10-23",
+				"in_production": false,
+				"external_ids": {"tvdb_id": 78804}
+			}`))
+		case "/3/tv/20/season/2/episode/3":
+			_, _ = w.Write([]byte(`{"air_date": "2006-04-29"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := New("key", WithBaseURL(server.URL+"/3"), WithLanguage("fr-FR"))
+
+	t.Run("should return movies with the aliases of the original language and the region", func(t *testing.T) {
+		meta, err := client.GetMovieById(context.Background(), "tt1")
+		require.NoError(t, err)
+		require.Equal(t, "Spirited Away", meta.Name)
+		require.Equal(t, uint(1), meta.IMDBID)
+		require.Equal(t, uint(10), meta.TMDBID)
+		require.Equal(t, "ja", meta.OriginalLanguage)
+		require.Equal(t, 2001, meta.FromYear)
+		require.Equal(t, []string{"千と千尋の神隠し", "Le Voyage de Chihiro"}, meta.Aliases)
+	})
+
+	t.Run("should only alias the original title without a region", func(t *testing.T) {
+		noRegionClient := New("key", WithBaseURL(server.URL+"/3"), WithLanguage("fr"))
+		meta, err := noRegionClient.GetMovieById(context.Background(), "tt1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"千と千尋の神隠し"}, meta.Aliases)
+	})
+
+	t.Run("should return series with the air date of the episode", func(t *testing.T) {
+		meta, err := client.GetSeriesById(context.Background(), "tt2", 2, 3)
+		require.NoError(t, err)
+		require.Equal(t, "Doctor Who", meta.Name)
+		require.Equal(t, uint(78804), meta.TVDBID)
+		require.Equal(t, 2005, meta.FromYear)
+		require.Equal(t, 2022, meta.ToYear)
+		require.Equal(t, 2006, meta.EpisodeYear)
+		require.Empty(t, meta.Aliases)
+	})
+
+	t.Run("should cache metas", func(t *testing.T) {
+		before := requests.Load()
+		_, err := client.GetSeriesById(context.Background(), "tt2", 2, 3)
+		require.NoError(t, err)
+		require.Equal(t, before, requests.Load())
+	})
+
+	t.Run("should keep series without the episode air date", func(t *testing.T) {
+		meta, err := client.GetSeriesById(context.Background(), "tt2", 9, 9)
+		require.NoError(t, err)
+		require.Equal(t, 0, meta.EpisodeYear)
+	})
+
+	t.Run("should report unknown IDs", func(t *testing.T) {
+		_, err := client.GetSeriesById(context.Background(), "tt3", 1, 1)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = client.GetMovieById(context.Background(), "tt2")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("should use read access tokens", func(t *testing.T) {
+		tokenClient := New("header.payload.signature", WithBaseURL(server.URL+"/3"))
+		meta, err := tokenClient.GetMovieById(context.Background(), "tt1")
+		require.NoError(t, err)
+		require.Equal(t, "Spirited Away", meta.Name)
+
+		invalidClient := New("invalid", WithBaseURL(server.URL+"/3"))
+		_, err = invalidClient.GetMovieById(context.Background(), "tt1")
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrNotFound)
+	})
+}